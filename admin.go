@@ -0,0 +1,191 @@
+package diffmirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+)
+
+// AdminHandler returns an http.Handler serving the admin api:
+//
+//	GET  /stats                 every counter, meter, timer and gauge
+//	GET  /settings              the options in use
+//	GET  /queue                 requests waiting for a worker, and whether paused
+//	GET  /buckets               requests, diffs and the diff rate of each bucket
+//	GET  /diffs                 the most recent diffs, newest first
+//	GET  /metrics               every stat, in the Prometheus text format
+//	POST /pause, /resume        stop and restart mirroring
+//	POST /sample-rate?rate=10%  change the fraction of requests mirrored
+//	POST /flush                 write out requests queued for the requests file
+func (m *Mirror) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		m.stats.WriteJSON(w)
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.stats.WritePrometheus(w)
+	})
+
+	mux.HandleFunc("/settings", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, optionsView(m.current.Load().settings))
+	})
+
+	mux.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"depth":    len(m.queue),
+			"capacity": cap(m.queue),
+			"paused":   m.paused.Load(),
+		})
+	})
+
+	mux.HandleFunc("/buckets", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.reporter.bucketCounts())
+	})
+
+	mux.HandleFunc("/diffs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.reporter.recent.get())
+	})
+
+	mux.HandleFunc("/pause", post(func(w http.ResponseWriter, r *http.Request) {
+		m.Pause()
+		log.Printf("Paused mirroring.")
+		w.Write([]byte("OK"))
+	}))
+
+	mux.HandleFunc("/resume", post(func(w http.ResponseWriter, r *http.Request) {
+		m.Resume()
+		log.Printf("Resumed mirroring.")
+		w.Write([]byte("OK"))
+	}))
+
+	mux.HandleFunc("/sample-rate", post(func(w http.ResponseWriter, r *http.Request) {
+		var rate Ratio
+		if err := rate.Set(r.FormValue("rate")); err != nil {
+			http.Error(w, "invalid rate: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.SetSampleRate(rate); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+
+	mux.HandleFunc("/flush", post(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.Flush(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+
+	return mux
+}
+
+// post rejects requests to f other than POSTs.
+func post(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, r.URL.Path+" requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		f(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("error encoding admin response: %s", err)
+	}
+}
+
+// optionsView renders each exported option as json, falling back to how it
+// is described when reloading for those json cannot encode.
+func optionsView(s *Options) map[string]interface{} {
+	v := reflect.ValueOf(s).Elem()
+
+	view := make(map[string]interface{})
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		f := v.Field(i)
+		if _, stringer := f.Addr().Interface().(fmt.Stringer); !stringer && f.Kind() != reflect.Interface {
+			if _, err := json.Marshal(f.Interface()); err == nil {
+				view[field.Name] = f.Interface()
+				continue
+			}
+		}
+		view[field.Name] = describeOption(f)
+	}
+	return view
+}
+
+// Pause stops mirroring: until Resume is called, requests are counted in
+// mirror.paused and otherwise ignored, except those being replayed, which wait.
+func (m *Mirror) Pause() {
+	m.pauseLock.Lock()
+	defer m.pauseLock.Unlock()
+
+	if !m.paused.Load() {
+		m.resumed = make(chan struct{})
+		m.paused.Store(true)
+	}
+}
+
+func (m *Mirror) Resume() {
+	m.pauseLock.Lock()
+	defer m.pauseLock.Unlock()
+
+	if m.paused.Load() {
+		m.paused.Store(false)
+		close(m.resumed)
+	}
+}
+
+// waitUntilResumed blocks while mirroring is paused.
+func (m *Mirror) waitUntilResumed() {
+	m.pauseLock.Lock()
+	resumed := m.resumed
+	paused := m.paused.Load()
+	m.pauseLock.Unlock()
+
+	if paused {
+		<-resumed
+	}
+}
+
+// SetSampleRate changes the fraction of requests mirrored, as if reloaded
+// with options differing only in SampleRate from those currently in use.
+func (m *Mirror) SetSampleRate(rate Ratio) error {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+
+	o := new(Options)
+	*o = *m.current.Load().given
+	o.SampleRate = rate
+	return m.reload(o)
+}
+
+// Flush writes out anything queued or buffered by sinks which are Flushers,
+// such as the requests file.
+func (m *Mirror) Flush() error {
+	for _, sink := range m.reporter.sinks {
+		if f, ok := sink.(Flusher); ok {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,4 +1,4 @@
-package main
+package diffmirror
 
 import (
 	"bytes"
@@ -7,15 +7,22 @@ import (
 	"strings"
 )
 
+// A Bucketer names the bucket a request falls in, given the request and its
+// body. Stats are kept for each bucket, and they can be compared differently.
 type Bucketer interface {
 	Bucket(r *http.Request, payload []byte) string
 }
 
+// RangeSlicer buckets requests by bytes start to end of the body.
 type RangeSlicer struct {
 	start int
 	end   int
 }
 
+func NewRangeSlicer(start, end int) *RangeSlicer {
+	return &RangeSlicer{start, end}
+}
+
 func (s *RangeSlicer) Bucket(r *http.Request, payload []byte) string {
 	end := s.end
 	if end >= len(payload) {
@@ -24,10 +31,15 @@ func (s *RangeSlicer) Bucket(r *http.Request, payload []byte) string {
 	return string(payload[s.start:end])
 }
 
+// CStringSlicer buckets requests by a null terminated string in the body.
 type CStringSlicer struct {
 	start int
 }
 
+func NewCStringSlicer(start int) *CStringSlicer {
+	return &CStringSlicer{start}
+}
+
 func (s *CStringSlicer) Bucket(r *http.Request, payload []byte) string {
 	if s.start >= len(payload) {
 		return ""
@@ -46,10 +58,16 @@ func (s *CStringSlicer) Bucket(r *http.Request, payload []byte) string {
 	return string(payload[s.start:end])
 }
 
+// StrLenSlicer buckets requests by a string in the body, prefixed by its
+// length as a big-endian int32.
 type StrLenSlicer struct {
 	pos int
 }
 
+func NewStrLenSlicer(pos int) *StrLenSlicer {
+	return &StrLenSlicer{pos}
+}
+
 func (s *StrLenSlicer) Bucket(r *http.Request, payload []byte) string {
 	if s.pos+4 >= len(payload) {
 		return ""
@@ -69,11 +87,17 @@ func (s *StrLenSlicer) Bucket(r *http.Request, payload []byte) string {
 	return string(payload[start:end])
 }
 
+// PathSlicer buckets requests by parts start to end of the path, joined
+// with "_".
 type PathSlicer struct {
 	start int
 	end   int
 }
 
+func NewPathSlicer(start, end int) *PathSlicer {
+	return &PathSlicer{start, end}
+}
+
 func (s *PathSlicer) Bucket(r *http.Request, payload []byte) string {
 	parts := strings.Split(r.RequestURI, "/")
 	start := s.start
@@ -88,3 +112,11 @@ func (s *PathSlicer) Bucket(r *http.Request, payload []byte) string {
 
 	return strings.Join(parts[start:end], "_")
 }
+
+// GRPCMethodBucketer buckets gRPC calls by their full method name,
+// eg `package.Service/Method`.
+type GRPCMethodBucketer struct{}
+
+func (s *GRPCMethodBucketer) Bucket(r *http.Request, payload []byte) string {
+	return strings.TrimPrefix(r.URL.Path, "/")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/dt/diffmirror"
+)
+
+// loadConfigFile sets each flag named in a json config file, unless it was
+// given on the command line, and returns the bucket policies it contains.
+func loadConfigFile(flags *flag.FlagSet, path string) (map[string]*diffmirror.BucketPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file map[string]json.RawMessage
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	names := make([]string, 0, len(file))
+	for name := range file {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buckets map[string]*diffmirror.BucketPolicy
+	for _, name := range names {
+		raw := file[name]
+
+		if name == "buckets" {
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&buckets); err != nil {
+				return nil, fmt.Errorf("buckets: %s", err)
+			}
+			continue
+		}
+
+		if name == "config" || flags.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown option %q", name)
+		}
+
+		if given[name] {
+			continue
+		}
+
+		values, err := configValues(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		for _, v := range values {
+			if err := flags.Set(name, v); err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+	return buckets, nil
+}
+
+// configValues renders a json value as the arguments to the flag it sets: a
+// list sets a repeated flag once for each element.
+func configValues(raw json.RawMessage) ([]string, error) {
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err == nil {
+		var values []string
+		for _, elem := range list {
+			v, err := configValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+
+	v, err := configValue(raw)
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, nil
+}
+
+func configValue(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	switch v.(type) {
+	case bool, float64:
+		// Numbers are passed as written, eg so ints are not reformatted.
+		return string(bytes.TrimSpace(raw)), nil
+	default:
+		return "", fmt.Errorf("expected a string, number, bool or list of them")
+	}
+}
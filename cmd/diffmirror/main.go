@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/dt/diffmirror"
+)
+
+// Exit status used when a replay exceeds one of the configured thresholds.
+const exitThresholdExceeded = 3
+
+// config holds the options of the mirror along with those of the CLI itself.
+type config struct {
+	*diffmirror.Options
+
+	listen string
+
+	tlsCert     string
+	tlsKey      string
+	tlsClientCA string
+
+	replayFile  string
+	verdictFile string
+
+	adminListen string
+
+	bucketPath    string
+	bucketBody    string
+	bucketStrLen  int
+	bucketCString int
+}
+
+func (s *config) setBucketer(b diffmirror.Bucketer) error {
+	if s.Bucketer != nil {
+		return fmt.Errorf("cannot specify more than one bucketing function")
+	}
+	s.Bucketer = b
+	return nil
+}
+
+func extractAlias(s, defaultValue string) (string, string) {
+	if strings.ContainsRune(s, '=') {
+		p := strings.SplitN(s, "=", 2)
+		return p[0], p[1]
+	}
+	return defaultValue, s
+}
+
+func intPair(s string) (int, int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("must provide 'start:end'")
+	}
+	start, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// splitHeaders parses a comma separated list of header names.
+func splitHeaders(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// listenerTLSConfig builds the configuration used to accept mirrored traffic
+// over TLS, requiring client certificates if a client CA is set.
+func listenerTLSConfig(s *config) (*tls.Config, error) {
+	cfg := new(tls.Config)
+	if s.tlsClientCA != "" {
+		pem, err := ioutil.ReadFile(s.tlsClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", s.tlsClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// parseConfig parses the command line, along with any config file it names.
+// They are parsed again, from scratch, when reloading.
+func parseConfig(args []string) (*config, error) {
+	s := &config{Options: diffmirror.DefaultOptions()}
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	var configFile string
+	flags.StringVar(&configFile, "config", "", "json file setting any of these options (by name, using a list for those which may be repeated) and per-bucket policies under 'buckets'. options given as flags take precedence.")
+
+	flags.BoolVar(&s.SkipDiff, "skip-diff", s.SkipDiff, "skip diffing and record stats only")
+
+	flags.StringVar(&s.tlsCert, "tls-cert", "", "file containing a PEM encoded certificate to serve TLS with")
+	flags.StringVar(&s.tlsKey, "tls-key", "", "file containing the PEM encoded key for tls-cert")
+	flags.StringVar(&s.tlsClientCA, "tls-client-ca", "", "file of PEM encoded CA certificates: if set, clients must present a certificate signed by one of them")
+
+	flags.StringVar(&s.ProtoA, "proto-a", s.ProtoA, "protocol to use to send to hostA: 'http1' or 'h2' (h2c over plaintext)")
+	flags.StringVar(&s.ProtoB, "proto-b", s.ProtoB, "protocol to use to send to hostB: 'http1' or 'h2' (h2c over plaintext)")
+	flags.StringVar(&s.ProtoA2, "proto-noise-host", s.ProtoA2, "protocol to use to send to the noise-host: 'http1' or 'h2' (h2c over plaintext)")
+
+	flags.StringVar(&s.UpstreamCA, "upstream-ca", s.UpstreamCA, "file of PEM encoded CA certificates used to verify https hosts")
+	flags.StringVar(&s.UpstreamCert, "upstream-cert", s.UpstreamCert, "file containing a PEM encoded client certificate to present to https hosts")
+	flags.StringVar(&s.UpstreamKey, "upstream-key", s.UpstreamKey, "file containing the PEM encoded key for upstream-cert")
+	flags.StringVar(&s.UpstreamServerName, "upstream-server-name", s.UpstreamServerName, "server name sent to (and verified against) https hosts, instead of their address")
+	flags.BoolVar(&s.InsecureSkipVerify, "insecure-skip-verify", s.InsecureSkipVerify, "do not verify certificates presented by https hosts")
+
+	flags.BoolVar(&s.ProxyPrimary, "proxy-primary", s.ProxyPrimary, "forward requests to hostA synchronously and return its response, instead of replying 'OK'")
+
+	var noiseHost string
+	flags.StringVar(&noiseHost, "noise-host", "", "[alias=]host running the same build as hostA. differences between hostA and hostB that also appear between hostA and this host are counted as noise rather than diffs. requires comparing structurally, eg with --compare json")
+
+	flags.IntVar(&s.Workers, "workers", s.Workers, "number of worker threads")
+	flags.IntVar(&s.MaxIdleConns, "max-idle-conns", s.MaxIdleConns, "maximum idle keep-alive connections to keep open to each host")
+	flags.IntVar(&s.MaxOpenConns, "max-open-conns", s.MaxOpenConns, "maximum connections to open to each host at once (0 for no limit)")
+
+	flags.StringVar(&s.RequestsFile, "requestsfile", s.RequestsFile, "filename in which to store requests that generated diffs")
+	flags.StringVar(&s.DiffLog, "diff-log", s.DiffLog, "filename to which to append a json line describing each diff")
+	flags.IntVar(&s.DiffLogMaxBody, "diff-log-max-body", s.DiffLogMaxBody, "truncate bodies in the diff log to this many bytes (0 for no limit)")
+
+	flags.Var(&s.MaxDiffRate, "max-diff-rate", "when replaying, fail if more than this fraction (or percentage, eg '0.1%') of requests differ")
+	flags.Var(&s.MaxErrorRate, "max-error-rate", "when replaying, fail if more than this fraction (or percentage) of requests to either host error")
+	flags.Var(&s.MaxP99Regression, "max-p99-regression", "when replaying, fail if hostB's p99 latency exceeds hostA's by more than this fraction (or percentage, eg '20%')")
+	flags.StringVar(&s.verdictFile, "verdict-file", "", "when replaying, write the final verdict as json to this file")
+
+	flags.BoolVar(&s.PrintStats, "stats", true, "print stats to console periodically")
+	flags.StringVar(&s.GraphiteHost, "graphite", s.GraphiteHost, "address of graphite receiver for stats")
+	flags.StringVar(&s.GraphitePrefix, "graphite-prefix", s.GraphitePrefix, "prefix for graphite writes")
+
+	flags.StringVar(&s.bucketPath, "bucket-by-path-parts", "", "start:end offsets for path parts (split by /) for bucketing")
+	flags.StringVar(&s.bucketBody, "bucket-by-body-slice", "", "start:end offsets to slice from the body for bucketing")
+	flags.IntVar(&s.bucketCString, "bucket-by-cstring", -1, "offset into body to find a null terminated string for bucketing")
+	flags.IntVar(&s.bucketStrLen, "bucket-by-strlen", -1, "offset into body to find a length int followed by string of length for bucketing")
+
+	flags.StringVar(&s.adminListen, "admin-listen", "", "address to serve the admin api on, eg '127.0.0.1:8001'")
+
+	flags.Var(&s.SampleRate, "sample-rate", "fraction (or percentage, eg '10%') of requests to mirror")
+
+	flags.StringVar(&s.RequireBucket, "require-bucket", s.RequireBucket, "only mirror requests matching bucket")
+	flags.StringVar(&s.ExcludeBucket, "exclude-bucket", s.ExcludeBucket, "ignore requests matching bucket")
+
+	flags.BoolVar(&s.IgnoreErrors, "ignore-errors", s.IgnoreErrors, "ignore network errors and 5xx responses")
+	flags.BoolVar(&s.CompareBodyOnly, "body-only", s.CompareBodyOnly, "compare only the body of responses (exclude headers)")
+	var compareHeaders, ignoreHeaders string
+	flags.StringVar(&compareHeaders, "compare-headers", "", "comma separated headers to compare, even when comparing only bodies. if set, other headers are not compared")
+	flags.StringVar(&ignoreHeaders, "ignore-headers", strings.Join(s.IgnoreHeaders, ","), "comma separated headers to exclude from comparison")
+	flags.BoolVar(&s.IgnoreBodyOrder, "ignore-content-order", s.IgnoreBodyOrder, "deprecated: use --unordered-array. comparison of body only confirms that they contain the same bytes, but not that the bytes appear in the same order.")
+	flags.StringVar(&s.CompareMode, "compare", s.CompareMode, "how to compare responses: 'bytes', 'json' (structurally, reporting differing paths) or 'status' (only status codes)")
+	flags.BoolVar(&s.GRPC, "grpc", s.GRPC, "accept and mirror gRPC calls (over h2c, or TLS), comparing gRPC status codes and bucketing by method by default")
+	flags.StringVar(&s.GRPCDescriptors, "grpc-descriptors", s.GRPCDescriptors, "with --grpc, a FileDescriptorSet (from protoc --include_imports --descriptor_set_out) used to decode and compare response messages field-by-field")
+	flags.StringVar(&s.Thrift, "thrift", s.Thrift, "decode thrift-over-http messages in the 'binary' or 'compact' protocol, comparing responses field-by-field and bucketing by method by default")
+	flags.Var(&s.IgnorePaths, "ignore-path", "when comparing structurally, remove values matching this JSONPath-like selector (eg '$.meta.requestId' or '$..timestamp') before comparison. may be repeated.")
+	flags.Var(&s.UnorderedArrays, "unordered-array", "when comparing structurally, ignore the order of elements of arrays matching this selector (eg '$.results'). may be repeated.")
+	flags.Var(&s.ArrayKeys, "array-key", "when comparing structurally, ignore the order of elements of an array, pairing them up by a field (eg '$.results[*].id'). may be repeated.")
+	flags.Float64Var(&s.FloatTolerance, "float-tolerance", s.FloatTolerance, "when comparing structurally, consider numbers differing by at most this much (eg 1e-6) equal")
+	flags.Var(&s.RelativeTolerance, "relative-tolerance", "when comparing structurally, consider numbers differing by at most this fraction (eg '0.01%') of the larger equal")
+	flags.Var(&s.Normalizers, "normalize", "apply a sed-style substitution (eg 's/[0-9a-f]{8}-[0-9a-f-]{27}/<uuid>/g') to both responses before comparison. may be repeated.")
+	flags.StringVar(&s.CompareCmd, "compare-cmd", s.CompareCmd, "compare differing same-length payloads by invoking cmd, passing as hex encoded args.")
+	flags.StringVar(&s.ComparatorServer, "comparator-server", s.ComparatorServer, "compare differing payloads by sending them to a single long-running process started with this command, one json object per line over its stdin and stdout.")
+	flags.DurationVar(&s.ComparatorTimeout, "comparator-timeout", s.ComparatorTimeout, "kill and restart the comparator server if it takes longer than this to respond")
+
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "\nUsage: %s [options] port [aliasA=][https://]hostA [aliasB=][https://]hostB\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [options] replay requestsfile [aliasA=][https://]hostA [aliasB=][https://]hostB\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if configFile != "" {
+		buckets, err := loadConfigFile(flags, configFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading config %s: %s", configFile, err)
+		}
+		s.Buckets = buckets
+	}
+
+	s.CompareHeaders = splitHeaders(compareHeaders)
+	s.IgnoreHeaders = splitHeaders(ignoreHeaders)
+
+	if s.bucketBody != "" {
+		start, end, err := intPair(s.bucketBody)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.setBucketer(diffmirror.NewRangeSlicer(start, end)); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.bucketPath != "" {
+		start, end, err := intPair(s.bucketPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.setBucketer(diffmirror.NewPathSlicer(start, end)); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.bucketStrLen != -1 {
+		if err := s.setBucketer(diffmirror.NewStrLenSlicer(s.bucketStrLen)); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.bucketCString != -1 {
+		if err := s.setBucketer(diffmirror.NewCStringSlicer(s.bucketCString)); err != nil {
+			return nil, err
+		}
+	}
+
+	args = flags.Args()
+	if len(args) > 0 && args[0] == "replay" {
+		args = args[1:]
+		if len(args) > 0 {
+			s.replayFile = args[0]
+		}
+	} else if len(args) > 0 {
+		s.listen = args[0]
+	}
+
+	if len(args) < 3 {
+		flags.Usage()
+		os.Exit(-1)
+	}
+
+	if s.replayFile == "" && (s.HasThresholds() || s.verdictFile != "") {
+		return nil, fmt.Errorf("thresholds and verdict-file are only supported when replaying")
+	}
+
+	s.NameA, s.HostA = extractAlias(args[1], "a")
+	s.NameB, s.HostB = extractAlias(args[2], "b")
+
+	if noiseHost != "" {
+		s.NameA2, s.HostA2 = extractAlias(noiseHost, "a2")
+	}
+
+	if (s.tlsCert == "") != (s.tlsKey == "") {
+		return nil, fmt.Errorf("tls-cert and tls-key must be specified together")
+	}
+
+	if s.tlsClientCA != "" && s.tlsCert == "" {
+		return nil, fmt.Errorf("tls-client-ca requires tls-cert and tls-key")
+	}
+
+	if s.listen != "" && !strings.ContainsRune(s.listen, ':') {
+		s.listen = ":" + s.listen
+	}
+
+	return s, nil
+}
+
+// reload parses the command line and config file again, and swaps the
+// options they give into m.
+func reload(m *diffmirror.Mirror) error {
+	s, err := parseConfig(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	return m.Reload(s.Options)
+}
+
+// reloadOnHangup reloads m whenever the process receives SIGHUP.
+func reloadOnHangup(m *diffmirror.Mirror) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reload(m); err != nil {
+			log.Printf("error reloading: %s", err)
+		}
+	}
+}
+
+// serveAdmin serves the admin api of m, along with /reload, which reloads it
+// on a POST.
+func serveAdmin(addr string, m *diffmirror.Mirror) {
+	mux := http.NewServeMux()
+	mux.Handle("/", m.AdminHandler())
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "reload requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(m); err != nil {
+			log.Printf("error reloading: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "OK")
+	})
+
+	log.Printf("Serving admin api on %s.", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+func main() {
+	s, err := parseConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	m, err := diffmirror.New(s.Options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	go reloadOnHangup(m)
+
+	if s.adminListen != "" {
+		go serveAdmin(s.adminListen, m)
+	}
+
+	if s.HostA2 != "" {
+		log.Printf("Using %s (%s) to detect noise in responses from %s.", s.HostA2, s.NameA2, s.NameA)
+	}
+
+	if s.replayFile != "" {
+		log.Printf("Replaying %s to %s (%s) and %s (%s).",
+			s.replayFile,
+			s.HostA, s.NameA,
+			s.HostB, s.NameB,
+		)
+		if err := m.Replay(s.replayFile); err != nil {
+			log.Fatal(err)
+		}
+		if err := m.Close(); err != nil {
+			log.Println(err)
+		}
+		m.PrintSummary()
+
+		if s.HasThresholds() || s.verdictFile != "" {
+			v := m.Verdict()
+			if s.verdictFile != "" {
+				if err := v.WriteFile(s.verdictFile); err != nil {
+					log.Fatal(err)
+				}
+			}
+			for _, f := range v.Failures {
+				log.Printf("FAIL: %s", f)
+			}
+			if !v.Pass {
+				os.Exit(exitThresholdExceeded)
+			}
+		}
+		return
+	}
+
+	srv := &http.Server{Addr: s.listen, Handler: m.Handler()}
+	if s.GRPC {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	log.Printf("Listening on %s and forwarding to %s (%s) and %s (%s).",
+		s.listen,
+		s.HostA, s.NameA,
+		s.HostB, s.NameB,
+	)
+
+	if s.tlsCert != "" {
+		cfg, err := listenerTLSConfig(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = cfg
+		log.Fatal(srv.ListenAndServeTLS(s.tlsCert, s.tlsKey))
+	}
+
+	log.Fatal(srv.ListenAndServe())
+}
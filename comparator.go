@@ -0,0 +1,280 @@
+package diffmirror
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Once a comparator server process fails, wait at least this long after
+// starting it before starting another, so one which cannot run is not
+// restarted for every request.
+var comparatorRestartDelay = time.Second
+
+// A comparatorServer is a long-running external process that compares
+// payloads. Requests and responses are json objects, one per line, written
+// to its stdin and read from its stdout, and matched up by id so that any
+// number may be outstanding at once. If it exits, responds with garbage or
+// takes longer than timeout to respond, it is killed and a new one started.
+type comparatorServer struct {
+	command string
+	args    []string
+	timeout time.Duration
+
+	// Guards proc, the process currently running, or that last failed.
+	lock    sync.Mutex
+	proc    *comparatorProcess
+	started time.Time
+	closed  bool
+}
+
+// A comparatorProcess is one run of a comparator server's command.
+type comparatorProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	// Held while writing a request, separately from lock, so responses can
+	// still be read meanwhile.
+	writeLock sync.Mutex
+	enc       *json.Encoder
+
+	lock    sync.Mutex
+	nextID  int64
+	pending map[int64]chan *comparatorResponse
+	// Set once the process stops responding.
+	err  error
+	done chan struct{}
+
+	stopOnce sync.Once
+	exitErr  error
+}
+
+type comparatorRequest struct {
+	ID     int64  `json:"id"`
+	Method string `json:"method"`
+	URI    string `json:"uri"`
+	A      []byte `json:"a"`
+	B      []byte `json:"b"`
+}
+
+type comparatorResponse struct {
+	ID          int64  `json:"id"`
+	Equal       bool   `json:"equal"`
+	Explanation string `json:"explanation,omitempty"`
+	// Optionally, the payloads as the comparator saw them after normalizing.
+	A []byte `json:"a,omitempty"`
+	B []byte `json:"b,omitempty"`
+}
+
+func startComparatorServer(command string, timeout time.Duration) (*comparatorServer, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty comparator server command")
+	}
+
+	c := &comparatorServer{command: command, args: args, timeout: timeout}
+	p, err := c.start()
+	if err != nil {
+		return nil, err
+	}
+	c.proc = p
+	c.started = time.Now()
+	return c, nil
+}
+
+func (c *comparatorServer) start() (*comparatorProcess, error) {
+	p := &comparatorProcess{
+		cmd:     exec.Command(c.args[0], c.args[1:]...),
+		pending: make(map[int64]chan *comparatorResponse),
+		done:    make(chan struct{}),
+	}
+	p.cmd.Stderr = os.Stderr
+
+	var err error
+	if p.stdin, err = p.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting comparator server %s: %s", c.command, err)
+	}
+	p.enc = json.NewEncoder(p.stdin)
+
+	go p.read(stdout)
+	return p, nil
+}
+
+// process returns the running process, first starting a new one if the last
+// failed.
+func (c *comparatorServer) process() (*comparatorProcess, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil, fmt.Errorf("comparator server closed")
+	}
+
+	err := c.proc.failed()
+	if err == nil {
+		return c.proc, nil
+	}
+	if time.Since(c.started) < comparatorRestartDelay {
+		return nil, err
+	}
+
+	log.Printf("Restarting comparator server %s after: %s", c.command, err)
+	c.proc.stop(0)
+	c.started = time.Now()
+	p, startErr := c.start()
+	if startErr != nil {
+		// Keep the failed process, so the next attempt waits again.
+		return nil, startErr
+	}
+	c.proc = p
+	return p, nil
+}
+
+// compare asks the comparator server whether a and b are equal.
+func (c *comparatorServer) compare(req *http.Request, a, b string) (*comparatorResponse, error) {
+	p, err := c.process()
+	if err != nil {
+		return nil, err
+	}
+
+	// A process which does not respond in time, or will not even read the
+	// request, is killed, failing every request waiting on it.
+	timer := time.AfterFunc(c.timeout, func() {
+		p.fail(fmt.Errorf("comparator server did not respond within %s", c.timeout))
+	})
+	defer timer.Stop()
+
+	return p.compare(req, a, b)
+}
+
+// Close asks the comparator server to exit, by closing its stdin, and waits
+// for it to do so, killing it if it does not within the timeout.
+func (c *comparatorServer) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.closed = true
+	if err := c.proc.stop(c.timeout); err != nil {
+		log.Printf("comparator server %s: %s", c.command, err)
+	}
+}
+
+func (p *comparatorProcess) read(stdout io.Reader) {
+	defer close(p.done)
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+
+	var err error
+	for scanner.Scan() {
+		res := new(comparatorResponse)
+		if err = json.Unmarshal(scanner.Bytes(), res); err != nil {
+			err = fmt.Errorf("invalid response from comparator server: %s", err)
+			break
+		}
+
+		p.lock.Lock()
+		back, found := p.pending[res.ID]
+		delete(p.pending, res.ID)
+		p.lock.Unlock()
+
+		if !found {
+			err = fmt.Errorf("comparator server responded to unknown id %d", res.ID)
+			break
+		}
+		back <- res
+	}
+	if err == nil {
+		if err = scanner.Err(); err == nil {
+			err = fmt.Errorf("comparator server exited")
+		}
+	}
+	p.fail(err)
+}
+
+// fail records why the process stopped responding, if it has not already,
+// fails every request waiting on it and kills it.
+func (p *comparatorProcess) fail(err error) {
+	p.lock.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	for id, back := range p.pending {
+		close(back)
+		delete(p.pending, id)
+	}
+	p.lock.Unlock()
+
+	p.cmd.Process.Kill()
+}
+
+// failed returns why the process stopped responding, if it has.
+func (p *comparatorProcess) failed() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// stop closes the process's stdin and waits for it to exit, killing it if
+// it has not within grace, and returns how it exited.
+func (p *comparatorProcess) stop(grace time.Duration) error {
+	p.stopOnce.Do(func() {
+		p.stdin.Close()
+		select {
+		case <-p.done:
+		case <-time.After(grace):
+			p.cmd.Process.Kill()
+			<-p.done
+		}
+		p.exitErr = p.cmd.Wait()
+	})
+	return p.exitErr
+}
+
+func (p *comparatorProcess) compare(req *http.Request, a, b string) (*comparatorResponse, error) {
+	back := make(chan *comparatorResponse, 1)
+
+	p.lock.Lock()
+	if p.err != nil {
+		p.lock.Unlock()
+		return nil, p.err
+	}
+	p.nextID++
+	id := p.nextID
+	p.pending[id] = back
+	p.lock.Unlock()
+
+	p.writeLock.Lock()
+	err := p.enc.Encode(comparatorRequest{ID: id, Method: req.Method, URI: req.RequestURI, A: []byte(a), B: []byte(b)})
+	p.writeLock.Unlock()
+
+	if err != nil {
+		p.lock.Lock()
+		delete(p.pending, id)
+		p.lock.Unlock()
+		return nil, fmt.Errorf("error writing to comparator server: %s", err)
+	}
+
+	res, ok := <-back
+	if !ok {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		return nil, p.err
+	}
+	return res, nil
+}
@@ -0,0 +1,157 @@
+package diffmirror
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// A Comparator decides whether two responses to a request differ, and how.
+// Comparators are run in a chain: each is passed the result of those before
+// it, starting with no differences, and returns it, refined. For example, a
+// comparator may only look at payloads which earlier ones found to differ.
+type Comparator interface {
+	Compare(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison
+}
+
+// ComparatorFunc adapts a function to a Comparator.
+type ComparatorFunc func(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison
+
+func (f ComparatorFunc) Compare(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison {
+	return f(req, resA, resB, c)
+}
+
+// The outcome of comparing two responses: the reasons, if any, they differ.
+type Comparison struct {
+	// Whether the payloads differ in a way not attributed to any path.
+	Payload bool
+	// Paths at which structured payloads differ, if they were compared as such.
+	Paths []string
+	// Headers that differ, if they were compared separately from the payload.
+	Headers []string
+
+	// Why the payloads differ and, optionally, the payloads as they were
+	// compared, which are shown in place of the originals.
+	Explanation              string
+	NormalizedA, NormalizedB []byte
+}
+
+func (c *Comparison) Same() bool {
+	return !c.Payload && len(c.Paths) == 0 && len(c.Headers) == 0
+}
+
+// without returns the differences in c that do not also appear in noise. Only
+// paths and headers are discounted: that two payloads differ says nothing of
+// whether they differ in the same way.
+func (c *Comparison) without(noise *Comparison) *Comparison {
+	return &Comparison{
+		Payload: c.Payload,
+		Paths:   subtract(c.Paths, noise.Paths),
+		Headers: subtract(c.Headers, noise.Headers),
+
+		Explanation: c.Explanation,
+		NormalizedA: c.NormalizedA,
+		NormalizedB: c.NormalizedB,
+	}
+}
+
+// shown returns res with its payload replaced by normalized, if set.
+func (c *Comparison) shown(res *MirrorResp, normalized []byte) *MirrorResp {
+	if normalized == nil {
+		return res
+	}
+	n := *res
+	n.payload = string(normalized)
+	return &n
+}
+
+func subtract(a, b []string) []string {
+	var out []string
+	for _, s := range a {
+		if !contains(b, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (c *Comparison) describe() string {
+	var parts []string
+	if len(c.Paths) > 0 {
+		parts = append(parts, "paths: "+strings.Join(c.Paths, " "))
+	}
+	if len(c.Headers) > 0 {
+		parts = append(parts, "headers: "+strings.Join(c.Headers, " "))
+	}
+	if c.Explanation != "" {
+		parts = append(parts, "explanation: "+c.Explanation)
+	}
+	return strings.Join(parts, " ")
+}
+
+// BytesComparator finds payloads differ unless they are identical.
+type BytesComparator struct{}
+
+func (BytesComparator) Compare(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison {
+	if resA.payload != resB.payload {
+		c.Payload = true
+	}
+	return c
+}
+
+// StatusComparator only compares the status codes of responses, reporting
+// them at the path "status" if they differ.
+type StatusComparator struct{}
+
+func (StatusComparator) Compare(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison {
+	if resA.status != resB.status {
+		c.Paths = append(c.Paths, "status")
+	}
+	return c
+}
+
+// SortedBytesComparator only confirms that payloads contain the same bytes,
+// but not that the bytes appear in the same order. Don't ask.
+type SortedBytesComparator struct{}
+
+func (SortedBytesComparator) Compare(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison {
+	if len(resA.payload) != len(resB.payload) {
+		c.Payload = true
+		return c
+	}
+
+	normA := []byte(resA.payload)
+	normB := []byte(resB.payload)
+	sort.Sort(sortBytes(normA))
+	sort.Sort(sortBytes(normB))
+	if !bytes.Equal(normA, normB) {
+		c.Payload = true
+	}
+	return c
+}
+
+// CommandComparator invokes Cmd, passing payloads found to differ as hex
+// encoded args, and considers them the same if it exits successfully. Only
+// payloads of the same length are passed to it.
+type CommandComparator struct {
+	Cmd string
+}
+
+func (s *CommandComparator) Compare(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison {
+	if !c.Payload || len(resA.payload) != len(resB.payload) {
+		return c
+	}
+
+	cmd := exec.Command(s.Cmd, hex.EncodeToString([]byte(resA.payload)), hex.EncodeToString([]byte(resB.payload)))
+	output, ret := cmd.CombinedOutput()
+	if ret != nil {
+		log.Printf("Compare via %s: %v:\n%s\n", s.Cmd, ret, output)
+		return c
+	}
+	c.Payload = false
+	return c
+}
@@ -0,0 +1,134 @@
+package diffmirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// A diffLog writes one json object per line describing each diff.
+type diffLog struct {
+	maxBody int
+	queue   chan []byte
+	out     *os.File
+	done    chan struct{}
+}
+
+type diffLogEntry struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	URI    string    `json:"uri"`
+	Bucket string    `json:"bucket,omitempty"`
+
+	RequestBody []byte `json:"request_body,omitempty"`
+
+	// Offset into the compared payloads of the first differing byte.
+	FirstDiff int `json:"first_diff"`
+
+	Paths       []string `json:"paths,omitempty"`
+	Headers     []string `json:"differing_headers,omitempty"`
+	Explanation string   `json:"explanation,omitempty"`
+
+	A diffLogResp `json:"a"`
+	B diffLogResp `json:"b"`
+}
+
+type diffLogResp struct {
+	Name       string      `json:"name"`
+	Status     int         `json:"status"`
+	Error      string      `json:"error,omitempty"`
+	Size       int         `json:"size"`
+	RTTMillis  float64     `json:"rtt_ms"`
+	DialMillis float64     `json:"dial_ms"`
+	Headers    http.Header `json:"headers"`
+	Body       []byte      `json:"body"`
+	Truncated  bool        `json:"truncated,omitempty"`
+}
+
+func newDiffLog(path string, maxBody int) (*diffLog, error) {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening diff log %s: %s", path, err)
+	}
+
+	l := &diffLog{
+		maxBody: maxBody,
+		queue:   make(chan []byte, 100),
+		out:     out,
+		done:    make(chan struct{}),
+	}
+	go l.write()
+	return l, nil
+}
+
+func (l *diffLog) write() {
+	for line := range l.queue {
+		if _, err := l.out.Write(line); err != nil {
+			log.Printf("error writing diff log: %s", err)
+		}
+	}
+	l.out.Close()
+	close(l.done)
+}
+
+func (l *diffLog) Close() error {
+	close(l.queue)
+	<-l.done
+	return nil
+}
+
+func logResp(name string, r *MirrorResp, maxBody int) diffLogResp {
+	e := diffLogResp{
+		Name:       name,
+		Status:     r.status,
+		Size:       len(r.payload),
+		RTTMillis:  float64(r.rtt) / float64(time.Millisecond),
+		DialMillis: float64(r.dial) / float64(time.Millisecond),
+		Headers:    r.header,
+		Body:       r.body,
+	}
+	if r.err != nil {
+		e.Error = r.err.Error()
+	}
+	if maxBody > 0 && len(e.Body) > maxBody {
+		e.Body = e.Body[:maxBody]
+		e.Truncated = true
+	}
+	return e
+}
+
+// newDiffLogEntry describes a diff, truncating bodies to maxBody bytes (0 for
+// no limit).
+func newDiffLogEntry(d *Diff, maxBody int) *diffLogEntry {
+	e := &diffLogEntry{
+		Time:        time.Now(),
+		Method:      d.Request.Method,
+		URI:         d.Request.RequestURI,
+		Bucket:      d.Bucket,
+		FirstDiff:   d.FirstDiff,
+		Paths:       d.Comparison.Paths,
+		Headers:     d.Comparison.Headers,
+		Explanation: d.Comparison.Explanation,
+		A:           logResp(d.NameA, d.A, maxBody),
+		B:           logResp(d.NameB, d.B, maxBody),
+	}
+
+	crlfcrlf := []byte("\r\n\r\n")
+	if cut := bytes.Index(d.Raw, crlfcrlf); cut > -1 {
+		e.RequestBody = d.Raw[cut+len(crlfcrlf):]
+	}
+	return e
+}
+
+func (l *diffLog) Diff(d *Diff) {
+	line, err := json.Marshal(newDiffLogEntry(d, l.maxBody))
+	if err != nil {
+		log.Printf("error encoding diff log entry: %s", err)
+		return
+	}
+	l.queue <- append(line, '\n')
+}
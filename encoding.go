@@ -0,0 +1,66 @@
+package diffmirror
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Bodies which decode to more than this are assumed to be garbage, or a
+// decompression bomb, rather than a real response.
+const maxDecodedBodySize = 64 * 1024 * 1024
+
+// decodeBody undoes the content codings listed in a Content-Encoding header,
+// which are applied in the order listed, failing if any decodes to more than
+// limit bytes.
+func decodeBody(encoding string, body []byte, limit int) ([]byte, error) {
+	codings := strings.Split(encoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+
+		var r io.Reader
+		var err error
+		switch coding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			// Meant to be zlib-wrapped, but some servers send raw deflate.
+			r, err = zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				r, err = flate.NewReader(bytes.NewReader(body)), nil
+			}
+		case "br":
+			r = brotli.NewReader(bytes.NewReader(body))
+		case "zstd":
+			var dec *zstd.Decoder
+			dec, err = zstd.NewReader(bytes.NewReader(body))
+			if err == nil {
+				defer dec.Close()
+				r = dec
+			}
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", coding)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s body: %s", coding, err)
+		}
+
+		if body, err = ioutil.ReadAll(io.LimitReader(r, int64(limit)+1)); err != nil {
+			return nil, fmt.Errorf("error decoding %s body: %s", coding, err)
+		}
+		if len(body) > limit {
+			return nil, fmt.Errorf("%s body decodes to more than %d bytes", coding, limit)
+		}
+	}
+	return body, nil
+}
@@ -0,0 +1,10 @@
+module github.com/dt/diffmirror
+
+go 1.24
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/klauspost/compress v1.18.0
+	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
+	google.golang.org/protobuf v1.36.9
+)
@@ -0,0 +1,150 @@
+package diffmirror
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// gRPC status codes that indicate the server, rather than the request, failed.
+var grpcErrorCodes = map[int]bool{
+	2:  true, // Unknown
+	4:  true, // DeadlineExceeded
+	13: true, // Internal
+	14: true, // Unavailable
+	15: true, // DataLoss
+}
+
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcStatus finds the status code a gRPC server returned, either in its
+// trailers or, for responses without a body, its headers.
+func grpcStatus(resp *http.Response) int {
+	s := resp.Trailer.Get("Grpc-Status")
+	if s == "" {
+		s = resp.Header.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil {
+		return 2 // Unknown
+	}
+	return code
+}
+
+// loadDescriptors reads a FileDescriptorSet, as written by
+// `protoc --include_imports --descriptor_set_out`.
+func loadDescriptors(path string) (*protoregistry.Files, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := new(descriptorpb.FileDescriptorSet)
+	if err := proto.Unmarshal(raw, set); err != nil {
+		return nil, fmt.Errorf("error parsing descriptors in %s: %s", path, err)
+	}
+	return protodesc.NewFiles(set)
+}
+
+// findOutput finds the response type for a request path like
+// `/package.Service/Method`.
+func findOutput(files *protoregistry.Files, path string) (protoreflect.MessageDescriptor, error) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%s is not a grpc method", path)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+	svc, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", parts[0])
+	}
+	method := svc.Methods().ByName(protoreflect.Name(parts[1]))
+	if method == nil {
+		return nil, fmt.Errorf("no method %s in %s", parts[1], parts[0])
+	}
+	return method.Output(), nil
+}
+
+// grpcMessages splits a gRPC body into its length-prefixed messages, failing
+// if any compressed message decompresses to more than limit bytes.
+func grpcMessages(body []byte, encoding string, limit int) ([][]byte, error) {
+	var msgs [][]byte
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return nil, fmt.Errorf("truncated message header")
+		}
+		compressed := body[0] == 1
+		size := binary.BigEndian.Uint32(body[1:5])
+		if uint32(len(body)-5) < size {
+			return nil, fmt.Errorf("truncated message")
+		}
+		msg := body[5 : 5+size]
+		body = body[5+size:]
+
+		if compressed {
+			if encoding != "gzip" {
+				return nil, fmt.Errorf("unsupported message encoding %q", encoding)
+			}
+			var err error
+			if msg, err = decodeBody(encoding, msg, limit); err != nil {
+				return nil, err
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// decodeGRPC decodes the messages in a gRPC response body to the same generic
+// values as decodeJSON, using field names as keys. A single message decodes
+// to an object, and a stream of them to an array.
+func decodeGRPC(desc protoreflect.MessageDescriptor, res *MirrorResp) (interface{}, error) {
+	msgs, err := grpcMessages(res.body, res.header.Get("Grpc-Encoding"), maxDecodedBodySize)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := protojson.MarshalOptions{UseProtoNames: true}
+	decoded := make([]interface{}, len(msgs))
+	for i, raw := range msgs {
+		msg := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(raw, msg); err != nil {
+			return nil, err
+		}
+		js, err := opts.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		if decoded[i], err = decodeJSON(js); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(decoded) == 1 {
+		return decoded[0], nil
+	}
+	return decoded, nil
+}
+
+// replyGRPC acknowledges a mirrored gRPC call without a response message.
+func replyGRPC(out http.ResponseWriter) {
+	out.Header().Set("Content-Type", "application/grpc")
+	out.Header().Set("Trailer", "Grpc-Status")
+	out.WriteHeader(http.StatusOK)
+	out.Header().Set("Grpc-Status", "0")
+}
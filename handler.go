@@ -1,30 +1,53 @@
-package main
+package diffmirror
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
 )
 
+// MirrorServer is the http.Handler returned by Mirror.Handler.
 type MirrorServer struct {
 	mirror *Mirror
 }
 
 func (m MirrorServer) ServeHTTP(out http.ResponseWriter, req *http.Request) {
 	req.URL.Scheme = "http"
+	if req.TLS != nil {
+		req.URL.Scheme = "https"
+	}
 	req.URL.Host = req.Host
 
 	raw, err := httputil.DumpRequestOut(req, true)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("error reading request: %s", err)
+		http.Error(out, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.mirror.begin()
+
+	if !m.mirror.settings.ProxyPrimary {
+		m.mirror.enqueue(&mirrorReq{raw: raw})
+		if m.mirror.settings.GRPC && isGRPC(req) {
+			replyGRPC(out)
+		} else {
+			fmt.Fprintf(out, "OK")
+		}
+		return
 	}
-	select {
-	case m.mirror.queue <- raw:
-		m.mirror.stats.Gauge("mirror.queue", len(m.mirror.queue))
-	default:
-		m.mirror.stats.Inc("mirror.dropped")
+
+	reqA, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		m.mirror.done()
+		http.Error(out, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	fmt.Fprintf(out, "OK")
+	snap := m.mirror.current.Load()
+	resA := m.mirror.a.proxy(out, reqA, snap.settings)
+	m.mirror.enqueue(&mirrorReq{raw: raw, resA: resA, snap: snap})
 }
@@ -0,0 +1,101 @@
+package diffmirror
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Headers that describe a single connection rather than the response, and so
+// depend on the protocol used to reach a host.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// canonicalHeaders returns the header names in their canonical form.
+func canonicalHeaders(names []string) []string {
+	var canonical []string
+	for _, name := range names {
+		canonical = append(canonical, http.CanonicalHeaderKey(name))
+	}
+	return canonical
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// comparesHeaders reports whether headers are compared at all.
+func (s *Options) comparesHeaders() bool {
+	return !s.CompareBodyOnly || len(s.CompareHeaders) > 0
+}
+
+// comparedHeaders returns the subset of h that should be compared: those
+// listed in CompareHeaders (or all, if it is empty) except for IgnoreHeaders
+// and hop-by-hop headers. Bodies are compared decoded, so Content-Encoding and
+// Content-Length, which describe the encoded body, are only compared if listed
+// explicitly.
+func (s *Options) comparedHeaders(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, v := range h {
+		if contains(hopHeaders, k) {
+			continue
+		}
+		if (k == "Content-Encoding" || k == "Content-Length") && !contains(s.CompareHeaders, k) {
+			continue
+		}
+		if len(s.CompareHeaders) > 0 && !contains(s.CompareHeaders, k) {
+			continue
+		}
+		if contains(s.IgnoreHeaders, k) {
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// comparesHeader reports whether comparedHeaders keeps the header name.
+func (s *Options) comparesHeader(name string) bool {
+	_, found := s.comparedHeaders(http.Header{name: nil})[name]
+	return found
+}
+
+// headerDiff returns the names of headers whose values differ between a and b.
+func headerDiff(a, b http.Header) []string {
+	var diffs []string
+	for k, va := range a {
+		if !stringsEqual(va, b[k]) {
+			diffs = append(diffs, k)
+		}
+	}
+	for k := range b {
+		if _, found := a[k]; !found {
+			diffs = append(diffs, k)
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
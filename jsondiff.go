@@ -0,0 +1,163 @@
+package diffmirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// decodeJSON parses a payload into generic values, keeping numbers as
+// json.Number so no precision is lost before comparison.
+func decodeJSON(payload []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after json value")
+	}
+	return v, nil
+}
+
+var plainKey = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func childPath(path, key string) string {
+	if plainKey.MatchString(key) {
+		return path + "." + key
+	}
+	return path + "['" + strings.Replace(key, "'", `\'`, -1) + "']"
+}
+
+func indexPath(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
+
+// A differ compares decoded values. Numbers within either tolerance of each
+// other are considered equal.
+type differ struct {
+	absTolerance float64
+	relTolerance float64
+
+	// If set, called with the difference between any numbers which are not
+	// exactly equal.
+	onDelta func(path string, delta float64)
+}
+
+// diff appends to diffs the paths, starting from path, at which the decoded
+// values a and b differ.
+func (d *differ) diff(path string, a, b interface{}, diffs []string) []string {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			return append(diffs, path)
+		}
+
+		keys := make([]string, 0, len(a)+len(b))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, found := a[k]; !found {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			va, inA := a[k]
+			vb, inB := b[k]
+			if !inA || !inB {
+				diffs = append(diffs, childPath(path, k))
+				continue
+			}
+			diffs = d.diff(childPath(path, k), va, vb, diffs)
+		}
+		return diffs
+
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok {
+			return append(diffs, path)
+		}
+
+		for i := 0; i < len(a) || i < len(b); i++ {
+			if i >= len(a) || i >= len(b) {
+				diffs = append(diffs, indexPath(path, i))
+				continue
+			}
+			diffs = d.diff(indexPath(path, i), a[i], b[i], diffs)
+		}
+		return diffs
+
+	case *unorderedArray:
+		b, ok := b.(*unorderedArray)
+		if !ok {
+			return append(diffs, path)
+		}
+		return d.diffUnordered(path, a, b, diffs)
+
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok || !d.numbersEqual(path, a, b) {
+			return append(diffs, path)
+		}
+		return diffs
+
+	default:
+		if a != b {
+			return append(diffs, path)
+		}
+		return diffs
+	}
+}
+
+// Integers beyond this magnitude cannot all be represented as a float64.
+var maxExactFloat = big.NewInt(1 << 53)
+
+// numbersEqual compares numbers within the differ's tolerances, except for
+// integers too large to be represented exactly as a float64, which are
+// compared exactly.
+func (d *differ) numbersEqual(path string, a, b json.Number) bool {
+	if a == b {
+		return true
+	}
+
+	ia, okA := new(big.Int).SetString(string(a), 10)
+	ib, okB := new(big.Int).SetString(string(b), 10)
+	if okA && okB && (new(big.Int).Abs(ia).Cmp(maxExactFloat) > 0 || new(big.Int).Abs(ib).Cmp(maxExactFloat) > 0) {
+		if ia.Cmp(ib) == 0 {
+			return true
+		}
+		if d.onDelta != nil {
+			delta, _ := new(big.Float).SetInt(new(big.Int).Sub(ia, ib)).Float64()
+			d.onDelta(path, math.Abs(delta))
+		}
+		return false
+	}
+
+	fa, errA := a.Float64()
+	fb, errB := b.Float64()
+	if errA != nil || errB != nil {
+		return false
+	}
+
+	delta := math.Abs(fa - fb)
+	if delta == 0 {
+		return true
+	}
+	if d.onDelta != nil {
+		d.onDelta(path, delta)
+	}
+	return delta <= d.absTolerance || delta <= d.relTolerance*math.Max(math.Abs(fa), math.Abs(fb))
+}
@@ -0,0 +1,237 @@
+package diffmirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A jsonSelector is a small subset of JSONPath: a `$` followed by any of
+// `.name`, `['name']`, `[3]`, `.*`, `[*]` and `..name` (which matches name at
+// any depth).
+type jsonSelector struct {
+	text  string
+	steps []selectorStep
+}
+
+type selectorStep struct {
+	// Descend any number of levels before matching.
+	recursive bool
+	wildcard  bool
+	key       string
+	index     int
+}
+
+func parseSelector(s string) (*jsonSelector, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("selector %q must start with $", s)
+	}
+
+	sel := &jsonSelector{text: s}
+	rest := s[1:]
+	for len(rest) > 0 {
+		step := selectorStep{index: -1}
+
+		if strings.HasPrefix(rest, "..") {
+			step.recursive = true
+			rest = rest[1:]
+			if len(rest) > 1 && rest[1] == '[' {
+				rest = rest[1:]
+			}
+		}
+
+		var err error
+		switch rest[0] {
+		case '.':
+			rest, err = parseName(rest[1:], &step)
+		case '[':
+			rest, err = parseBracket(rest, &step)
+		default:
+			err = fmt.Errorf("unexpected %q", rest)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %s", s, err)
+		}
+		sel.steps = append(sel.steps, step)
+	}
+
+	if len(sel.steps) == 0 {
+		return nil, fmt.Errorf("selector %q matches the whole document", s)
+	}
+	return sel, nil
+}
+
+func parseName(rest string, step *selectorStep) (string, error) {
+	end := strings.IndexAny(rest, ".[")
+	if end == -1 {
+		end = len(rest)
+	}
+	if end == 0 {
+		return "", fmt.Errorf("missing name")
+	}
+	if rest[:end] == "*" {
+		step.wildcard = true
+	} else {
+		step.key = rest[:end]
+	}
+	return rest[end:], nil
+}
+
+func parseBracket(rest string, step *selectorStep) (string, error) {
+	end := strings.IndexByte(rest, ']')
+	if end == -1 {
+		return "", fmt.Errorf("unterminated [")
+	}
+	inner := rest[1:end]
+
+	switch {
+	case inner == "*":
+		step.wildcard = true
+	case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+		step.key = strings.Replace(inner[1:len(inner)-1], `\`+inner[:1], inner[:1], -1)
+	default:
+		i, err := strconv.Atoi(inner)
+		if err != nil || i < 0 {
+			return "", fmt.Errorf("invalid index %q", inner)
+		}
+		step.index = i
+	}
+	return rest[end+1:], nil
+}
+
+func (s *jsonSelector) String() string {
+	return s.text
+}
+
+// remove deletes everything the selector matches from v, returning the
+// modified value.
+func (s *jsonSelector) remove(v interface{}) interface{} {
+	return transformSteps(v, s.steps, func(interface{}) interface{} {
+		return removed{}
+	})
+}
+
+// replace substitutes f(match) for everything the selector matches in v,
+// returning the modified value.
+func (s *jsonSelector) replace(v interface{}, f func(interface{}) interface{}) interface{} {
+	return transformSteps(v, s.steps, f)
+}
+
+// Returned by a transform to delete the matched value.
+type removed struct{}
+
+func isRemoved(v interface{}) bool {
+	_, ok := v.(removed)
+	return ok
+}
+
+func (s selectorStep) matchesKey(k string) bool {
+	return s.index == -1 && (s.wildcard || s.key == k)
+}
+
+func (s selectorStep) matchesIndex(i int) bool {
+	return s.key == "" && (s.wildcard || s.index == i)
+}
+
+func transformSteps(v interface{}, steps []selectorStep, f func(interface{}) interface{}) interface{} {
+	step, rest := steps[0], steps[1:]
+
+	if step.recursive {
+		here := step
+		here.recursive = false
+		v = transformSteps(v, append([]selectorStep{here}, rest...), f)
+
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, child := range v {
+				v[k] = transformSteps(child, steps, f)
+			}
+		case []interface{}:
+			for i, child := range v {
+				v[i] = transformSteps(child, steps, f)
+			}
+		}
+		return v
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if !step.matchesKey(k) {
+				continue
+			}
+			if len(rest) > 0 {
+				v[k] = transformSteps(child, rest, f)
+			} else if r := f(child); isRemoved(r) {
+				delete(v, k)
+			} else {
+				v[k] = r
+			}
+		}
+		return v
+
+	case []interface{}:
+		if len(rest) == 0 {
+			kept := v[:0]
+			for i, child := range v {
+				if !step.matchesIndex(i) {
+					kept = append(kept, child)
+				} else if r := f(child); !isRemoved(r) {
+					kept = append(kept, r)
+				}
+			}
+			return kept
+		}
+		for i, child := range v {
+			if step.matchesIndex(i) {
+				v[i] = transformSteps(child, rest, f)
+			}
+		}
+		return v
+	}
+	return v
+}
+
+// A flag accepting any number of selectors.
+type SelectorList []*jsonSelector
+
+func (l *SelectorList) String() string {
+	parts := make([]string, len(*l))
+	for i, s := range *l {
+		parts[i] = s.text
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *SelectorList) Set(v string) error {
+	s, err := parseSelector(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+func (l SelectorList) MarshalJSON() ([]byte, error) {
+	texts := make([]string, len(l))
+	for i, s := range l {
+		texts[i] = s.text
+	}
+	return json.Marshal(texts)
+}
+
+// UnmarshalJSON accepts an array of selectors.
+func (l *SelectorList) UnmarshalJSON(b []byte) error {
+	var texts []string
+	if err := json.Unmarshal(b, &texts); err != nil {
+		return err
+	}
+	*l = SelectorList{}
+	for _, text := range texts {
+		if err := l.Set(text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
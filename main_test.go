@@ -1,13 +1,35 @@
-package main
+package diffmirror
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/dt/gor_request_files/requestfiles"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 func server(head, body string) *httptest.Server {
@@ -18,44 +40,64 @@ func server(head, body string) *httptest.Server {
 	return s
 }
 
-func mockSettings(bodyOnly, ignoreErrors bool) *Settings {
-	s := new(Settings)
-	s.workers = 1
-	s.trackWork = true
-	s.compareBodyOnly = bodyOnly
-	s.ignoreErrors = ignoreErrors
+func mockSettings(bodyOnly, ignoreErrors bool) *Options {
+	s := DefaultOptions()
+	s.Workers = 1
+	s.CompareBodyOnly = bodyOnly
+	s.IgnoreErrors = ignoreErrors
 	return s
 }
 
-func runOne(t *testing.T, s *Settings, headA, headB, bodyA, bodyB string) *Stats {
+func mustNew(t *testing.T, s *Options) *Mirror {
+	m, err := New(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func runOne(t *testing.T, s *Options, headA, headB, bodyA, bodyB string) *Stats {
+	stats, _ := runOneWithResponse(t, s, headA, headB, bodyA, bodyB)
+	return stats
+}
+
+func runOneWithResponse(t *testing.T, s *Options, headA, headB, bodyA, bodyB string) (*Stats, *http.Response) {
 	a := server(headA, bodyA)
 	defer a.Close()
 
 	b := server(headB, bodyB)
 	defer b.Close()
 
-	s.nameA = "a"
-	s.hostA = strings.Replace(a.URL, "http://", "", -1)
-	s.nameB = "b"
-	s.hostB = strings.Replace(b.URL, "http://", "", -1)
+	s.NameA = "a"
+	s.HostA = strings.Replace(a.URL, "http://", "", -1)
+	s.NameB = "b"
+	s.HostB = strings.Replace(b.URL, "http://", "", -1)
 
-	m := NewMirror(s)
+	m := mustNew(t, s)
+	defer m.Close()
 
-	diffmirror := httptest.NewServer(MirrorServer{mirror: m})
+	diffmirror := httptest.NewServer(m.Handler())
 	defer diffmirror.Close()
 
 	if !testing.Verbose() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	_, err := http.Get(diffmirror.URL)
+	resp, err := http.Get(diffmirror.URL)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer resp.Body.Close()
 
-	m.working.Wait()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body = ioutil.NopCloser(strings.NewReader(string(body)))
 
-	return m.stats
+	m.Wait()
+
+	return m.stats, resp
 }
 
 func expectStat(t *testing.T, s *Stats, stat string, expected int) {
@@ -101,7 +143,7 @@ func TestBodyOOOFailDiff(t *testing.T) {
 	expectStat(t, a, "diffing.match", 0)
 	expectStat(t, a, "diffing.diff", 1)
 
-	m.ignoreBodyOrder = true
+	m.IgnoreBodyOrder = true
 	b := runOne(t, m, "headerA", "headerB", "body", "ybod")
 	expectStat(t, b, "diffing.total", 1)
 	expectStat(t, b, "diffing.match", 1)
@@ -116,7 +158,7 @@ func TestCompCmd(t *testing.T) {
 	expectStat(t, a, "diffing.match", 0)
 	expectStat(t, a, "diffing.diff", 1)
 
-	m.compareCmd = "testing/silly_diff.py"
+	m.CompareCmd = "testing/silly_diff.py"
 	b := runOne(t, m, "headerA", "headerB", "bodyXbody", "bodyYbody")
 	expectStat(t, b, "diffing.total", 1)
 	expectStat(t, b, "diffing.match", 1)
@@ -128,3 +170,1463 @@ func TestCompCmd(t *testing.T) {
 	expectStat(t, c, "diffing.diff", 1)
 
 }
+
+func TestComparatorServer(t *testing.T) {
+	m := mockSettings(true, false)
+	m.ComparatorServer = "testing/comparator_server.py"
+
+	a := runOne(t, m, "headerA", "headerB", "Hello", "HELLO")
+	expectStat(t, a, "diffing.match", 1)
+	expectStat(t, a, "diffing.diff", 0)
+
+	b := runOne(t, m, "headerA", "headerB", "Hello", "HELLO!")
+	expectStat(t, b, "diffing.match", 0)
+	expectStat(t, b, "diffing.diff", 1)
+	expectStat(t, b, "diffing.comparator-error", 0)
+}
+
+func TestComparatorServerFailures(t *testing.T) {
+	defer func(d time.Duration) { comparatorRestartDelay = d }(comparatorRestartDelay)
+	comparatorRestartDelay = 0
+
+	// Each host responds with the path, B in upper case.
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.ToUpper(r.URL.Path))
+	}))
+	defer b.Close()
+
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	s := mockSettings(true, false)
+	s.HostA, s.HostB = a.URL, b.URL
+	s.ComparatorServer = "testing/flaky_comparator.py"
+	s.ComparatorTimeout = 500 * time.Millisecond
+	m := mustNew(t, s)
+	defer m.Close()
+
+	// After each failure, the server is restarted for the next request.
+	for i, path := range []string{"/crash", "/hang", "/garbage", "/hello"} {
+		req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		raw, err := httputil.DumpRequestOut(req, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Submit(raw)
+		m.Wait()
+		expectStat(t, m.Stats(), "diffing.comparator-error", min(i+1, 3))
+	}
+	expectStat(t, m.Stats(), "diffing.diff", 3)
+	expectStat(t, m.Stats(), "diffing.match", 1)
+}
+
+type constBucketer string
+
+func (b constBucketer) Bucket(r *http.Request, payload []byte) string {
+	return string(b)
+}
+
+func TestComparatorChains(t *testing.T) {
+	caseInsensitive := ComparatorFunc(func(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison {
+		if !strings.EqualFold(resA.Payload(), resB.Payload()) {
+			c.Payload = true
+			c.Explanation = "differ by more than case"
+		}
+		return c
+	})
+
+	m := mockSettings(true, false)
+	m.Comparators = map[string][]Comparator{"lenient": {caseInsensitive}}
+
+	m.Bucketer = constBucketer("lenient")
+	a := runOne(t, m, "headerA", "headerB", "Hello", "HELLO")
+	expectStat(t, a, "diffing.match", 1)
+
+	m.Bucketer = constBucketer("strict")
+	b := runOne(t, m, "headerA", "headerB", "Hello", "HELLO")
+	expectStat(t, b, "diffing.diff", 1)
+
+	// Later comparators see what earlier ones found.
+	m.Comparators[""] = []Comparator{BytesComparator{}, &CommandComparator{Cmd: "testing/silly_diff.py"}}
+	c := runOne(t, m, "headerA", "headerB", "bodyXbody", "bodyYbody")
+	expectStat(t, c, "diffing.match", 1)
+
+	m.Comparators[""] = []Comparator{SortedBytesComparator{}}
+	d := runOne(t, m, "headerA", "headerB", "abc", "cba")
+	expectStat(t, d, "diffing.match", 1)
+}
+
+func TestBucketPolicies(t *testing.T) {
+	var buckets map[string]*BucketPolicy
+	err := json.Unmarshal([]byte(`{
+		"search": {"compare": "json", "float-tolerance": 0.01, "ignore-path": ["$.id"]},
+		"thumbnail": {"compare": "status"},
+		"health": {"sample-rate": "0%"}
+	}`), &buckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := mockSettings(true, false)
+	m.Buckets = buckets
+
+	m.Bucketer = constBucketer("search")
+	a := runOne(t, m, "header", "header", `{"id": 1, "score": 0.5}`, `{"id": 2, "score": 0.501}`)
+	expectStat(t, a, "diffing.match", 1)
+
+	m.Bucketer = constBucketer("thumbnail")
+	b := runOne(t, m, "header", "header", "small", "large")
+	expectStat(t, b, "diffing.match", 1)
+
+	m.Bucketer = constBucketer("health")
+	c := runOne(t, m, "header", "header", "up", "down")
+	expectStat(t, c, "mirror.sampled-out", 1)
+	expectStat(t, c, "diffing.total", 0)
+
+	m.Bucketer = constBucketer("other")
+	d := runOne(t, m, "header", "header", "small", "large")
+	expectStat(t, d, "diffing.diff", 1)
+
+	var paths SelectorList
+	paths.Set("$.id")
+	m.Buckets = map[string]*BucketPolicy{"other": {IgnorePaths: paths}}
+	if _, err := New(m); err == nil {
+		t.Error("expected error for ignore-path when comparing bytes")
+	}
+
+	m.Thrift = "binary"
+	m.Buckets = map[string]*BucketPolicy{"getUser": {CompareMode: "json"}}
+	if _, err := New(m); err == nil || !strings.Contains(err.Error(), "thrift responses cannot be compared with compare json") {
+		t.Errorf("expected error for comparing thrift responses as json, got %v", err)
+	}
+	m.Buckets = map[string]*BucketPolicy{"getUser": {CompareMode: "status"}}
+	if mirror, err := New(m); err != nil {
+		t.Errorf("expected thrift responses to be compared by status, got %v", err)
+	} else {
+		mirror.Close()
+	}
+}
+
+func TestProxyPrimary(t *testing.T) {
+	m := mockSettings(true, false)
+	m.ProxyPrimary = true
+
+	s, resp := runOneWithResponse(t, m, "headerA", "headerB", "bodyA", "bodyB")
+	expectStat(t, s, "diffing.total", 1)
+	expectStat(t, s, "diffing.match", 0)
+	expectStat(t, s, "diffing.diff", 1)
+
+	if h := resp.Header.Get("X-diffmirror-test"); h != "headerA" {
+		t.Errorf("expected header from a, got %q", h)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "bodyA\n" {
+		t.Errorf("expected body from a, got %q", body)
+	}
+}
+
+// writeRequests writes count requests to a gor file for replaying, returning
+// its path, and quiets the log replaying them writes unless testing verbosely.
+func writeRequests(t *testing.T, count int) string {
+	path := filepath.Join(t.TempDir(), "requests.gor")
+	out := requestfiles.NewFileOutput(path)
+	for i := 0; i < count; i++ {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/%d", i), nil)
+		raw, err := httputil.DumpRequestOut(req, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Write(raw)
+	}
+	if c, ok := interface{}(out).(interface{ Close() error }); ok {
+		c.Close()
+	}
+
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	return path
+}
+
+func replayAll(t *testing.T, s *Options, bodyA, bodyB string, count int) *Mirror {
+	a := server("header", bodyA)
+	defer a.Close()
+
+	b := server("header", bodyB)
+	defer b.Close()
+
+	path := writeRequests(t, count)
+
+	s.NameA = "a"
+	s.HostA = strings.Replace(a.URL, "http://", "", -1)
+	s.NameB = "b"
+	s.HostB = strings.Replace(b.URL, "http://", "", -1)
+
+	m := mustNew(t, s)
+	if err := m.Replay(path); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	return m
+}
+
+func TestReplay(t *testing.T) {
+	m := replayAll(t, mockSettings(true, false), "body", "body", 3)
+	expectStat(t, m.stats, "diffing.total", 3)
+	expectStat(t, m.stats, "diffing.match", 3)
+	expectStat(t, m.stats, "diffing.diff", 0)
+}
+
+func TestVerdict(t *testing.T) {
+	s := mockSettings(true, false)
+	s.MaxDiffRate.Set("50%")
+
+	pass := replayAll(t, s, "body", "body", 3).Verdict()
+	if !pass.Pass || pass.DiffRate != 0 {
+		t.Errorf("expected passing verdict, got %+v", pass)
+	}
+
+	fail := replayAll(t, s, "bodyA", "bodyB", 3).Verdict()
+	if fail.Pass || fail.DiffRate != 1 || len(fail.Failures) != 1 {
+		t.Errorf("expected failing verdict, got %+v", fail)
+	}
+}
+
+func TestDiffLog(t *testing.T) {
+	s := mockSettings(true, false)
+	s.DiffLog = filepath.Join(t.TempDir(), "diffs.jsonl")
+	s.DiffLogMaxBody = 4
+
+	replayAll(t, s, "bodyA", "bodyB", 2)
+
+	f, err := os.Open(s.DiffLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e diffLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.FirstDiff != 4 || e.A.Name != "a" || string(e.A.Body) != "body" || !e.B.Truncated {
+			t.Errorf("unexpected diff log entry %s", scanner.Text())
+		}
+		if e.A.Headers.Get("X-diffmirror-test") != "header" {
+			t.Errorf("expected headers in diff log entry %s", scanner.Text())
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("expected 2 diff log entries, got %d", lines)
+	}
+}
+
+func TestJSONCompare(t *testing.T) {
+	m := mockSettings(true, false)
+	m.CompareMode = "json"
+
+	a := runOne(t, m, "headerA", "headerB", `{"a": 1, "b": [1, 2.0]}`, `{"b":[1,2],"a":1}`)
+	expectStat(t, a, "diffing.total", 1)
+	expectStat(t, a, "diffing.match", 1)
+	expectStat(t, a, "diffing.diff", 0)
+
+	b := runOne(t, m, "headerA", "headerB", `{"items": [{"price": 1}, {"price": 2}]}`, `{"items": [{"price": 1}, {"price": 3}], "x": null}`)
+	expectStat(t, b, "diffing.total", 1)
+	expectStat(t, b, "diffing.match", 0)
+	expectStat(t, b, "diffing.diff", 1)
+	// Counters are kept by path with array indexes replaced, so only one of
+	// the prices is counted.
+	expectStat(t, b, "diffing.path.$.items[*].price", 1)
+	expectStat(t, b, "diffing.path.$.x", 1)
+	expectStat(t, b, "diffing.path.$.items[1].price", 0)
+}
+
+func TestJSONDiffPaths(t *testing.T) {
+	a, _ := decodeJSON([]byte(`{"a b": [1, {"c": "x"}], "d": true}`))
+	b, _ := decodeJSON([]byte(`{"a b": [1, {"c": "y"}, 3], "d": "true"}`))
+
+	diffs := new(differ).diff("$", a, b, nil)
+	expected := []string{`$['a b'][1].c`, `$['a b'][2]`, `$.d`}
+	if strings.Join(diffs, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, diffs)
+	}
+}
+
+func TestIgnorePaths(t *testing.T) {
+	m := mockSettings(true, false)
+	m.CompareMode = "json"
+
+	bodyA := `{"meta": {"requestId": "abc"}, "items": [{"id": 1, "timestamp": 5}], "timestamp": 1, "id": 1}`
+	bodyB := `{"meta": {"requestId": "def"}, "items": [{"id": 1, "timestamp": 6}], "timestamp": 2, "id": 1}`
+
+	a := runOne(t, m, "headerA", "headerB", bodyA, bodyB)
+	expectStat(t, a, "diffing.diff", 1)
+
+	for _, p := range []string{"$.meta.requestId", "$..timestamp"} {
+		if err := m.IgnorePaths.Set(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := runOne(t, m, "headerA", "headerB", bodyA, bodyB)
+	expectStat(t, b, "diffing.match", 1)
+	expectStat(t, b, "diffing.diff", 0)
+}
+
+func TestTolerance(t *testing.T) {
+	bodyA := `{"scores": [{"v": 1.0000001}, {"v": 200}], "n": 3}`
+	bodyB := `{"scores": [{"v": 1.0000002}, {"v": 201}], "n": 3}`
+
+	m := mockSettings(true, false)
+	m.CompareMode = "json"
+	m.FloatTolerance = 1e-6
+
+	a := runOne(t, m, "headerA", "headerB", bodyA, bodyB)
+	expectStat(t, a, "diffing.diff", 1)
+	expectStat(t, a, "diffing.path.$.scores[*].v", 1)
+	if delta := a.GetGaugeFloat("diffing.delta.$.scores[*].v"); delta != 1 {
+		t.Errorf("expected max delta 1, got %v", delta)
+	}
+
+	if err := m.RelativeTolerance.Set("1%"); err != nil {
+		t.Fatal(err)
+	}
+	b := runOne(t, m, "headerA", "headerB", bodyA, bodyB)
+	expectStat(t, b, "diffing.match", 1)
+
+	// Integers beyond the precision of a float64 are compared exactly.
+	c := runOne(t, m, "headerA", "headerB", `{"id": 9007199254740993, "n": 200}`, `{"id": 9007199254740992, "n": 201}`)
+	expectStat(t, c, "diffing.path.$.id", 1)
+	expectStat(t, c, "diffing.path.$.n", 0)
+	if delta := c.GetGaugeFloat("diffing.delta.$.id"); delta != 1 {
+		t.Errorf("expected max delta 1, got %v", delta)
+	}
+}
+
+func TestUnorderedArrays(t *testing.T) {
+	var arrays, keys SelectorList
+	for _, p := range []string{"$.tags", "$.results[*].tags"} {
+		if err := arrays.Set(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := keys.Set("$.results[*].id"); err != nil {
+		t.Fatal(err)
+	}
+	specs, err := unorderedSpecs(arrays, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &policy{settings: &Options{unorderedArrays: specs}, differ: new(differ)}
+
+	for _, tc := range []struct {
+		a, b     string
+		expected string
+	}{
+		{`{"tags": [1, 2, 2], "order": [1, 2]}`, `{"tags": [2, 1, 2], "order": [1, 2]}`, ``},
+		{`{"tags": [1, 2], "order": [1, 2]}`, `{"tags": [1, 2], "order": [2, 1]}`, `$.order[0],$.order[1]`},
+		{`{"tags": [1, 2, 2]}`, `{"tags": [2, 1, 1]}`, `$.tags[2]`},
+		{`{"tags": [1, {"x": 1}]}`, `{"tags": [{"x": 2}, 1]}`, `$.tags[1].x`},
+		{`{"tags": [1, 2]}`, `{"tags": [2, 1, 3]}`, `$.tags[2]`},
+		{
+			`{"results": [{"id": 1, "v": "a", "tags": ["x", "y"]}, {"id": 2, "v": "b"}]}`,
+			`{"results": [{"id": 2, "v": "c"}, {"id": 1, "v": "a", "tags": ["y", "x"]}]}`,
+			`$.results[1].v`,
+		},
+		{
+			`{"results": [{"id": 1}, {"id": 2}]}`,
+			`{"results": [{"id": 3}, {"id": 1}]}`,
+			`$.results[1],$.results[0]`,
+		},
+	} {
+		a, _ := decodeJSON([]byte(tc.a))
+		b, _ := decodeJSON([]byte(tc.b))
+		if diffs := strings.Join(d.structDiff(a, b, nil), ","); diffs != tc.expected {
+			t.Errorf("%s vs %s: expected %q, got %q", tc.a, tc.b, tc.expected, diffs)
+		}
+	}
+
+	for _, bad := range []string{"$.results", "$.results[*]", "$.results[0].id"} {
+		var keys SelectorList
+		keys.Set(bad)
+		if _, err := unorderedSpecs(nil, keys); err == nil {
+			t.Errorf("expected error for array key %q", bad)
+		}
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	doc := `{"a": [{"b": 1, "c": 2}, {"b": 3}], "d": {"b": 4, "e f": 5}}`
+	for sel, expected := range map[string]string{
+		"$.a[0].b":    `{"a":[{"c":2},{"b":3}],"d":{"b":4,"e f":5}}`,
+		"$.a[*].b":    `{"a":[{"c":2},{}],"d":{"b":4,"e f":5}}`,
+		"$..b":        `{"a":[{"c":2},{}],"d":{"e f":5}}`,
+		"$.a[1]":      `{"a":[{"b":1,"c":2}],"d":{"b":4,"e f":5}}`,
+		"$.d['e f']":  `{"a":[{"b":1,"c":2},{"b":3}],"d":{"b":4}}`,
+		"$.*":         `{}`,
+		"$.missing.x": `{"a":[{"b":1,"c":2},{"b":3}],"d":{"b":4,"e f":5}}`,
+	} {
+		s, err := parseSelector(sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, _ := decodeJSON([]byte(doc))
+		actual, _ := json.Marshal(s.remove(v))
+		if string(actual) != expected {
+			t.Errorf("%s: expected %s, got %s", sel, expected, actual)
+		}
+	}
+
+	for _, bad := range []string{"a.b", "$", "$.a[", "$.a[x]", "$..", "$.a..", "$a"} {
+		if _, err := parseSelector(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	m := mockSettings(true, false)
+
+	bodyA := "id 0f8fad5b-d9cb-469f-a165-70867728950e at host-a1"
+	bodyB := "id 7c9e6679-7425-40de-944b-e07fc1f90ae7 at host-b2"
+
+	a := runOne(t, m, "headerA", "headerB", bodyA, bodyB)
+	expectStat(t, a, "diffing.diff", 1)
+
+	for _, n := range []string{`s/[0-9a-f]{8}-[0-9a-f-]{27}/<uuid>/`, `s|HOST-[a-z]([0-9])|host-\1|i`} {
+		if err := m.Normalizers.Set(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := runOne(t, m, "headerA", "headerB", bodyA, bodyB)
+	expectStat(t, b, "diffing.diff", 1)
+	expectStat(t, b, "diffing.normalized.1", 2)
+	expectStat(t, b, "diffing.normalized.2", 2)
+
+	m.Normalizers = nil
+	m.Normalizers.Set(`s/host-[ab][0-9]/host/`)
+	m.Normalizers.Set(`s/[0-9a-f]{8}-[0-9a-f-]{27}/<uuid>/g`)
+	c := runOne(t, m, "headerA", "headerB", bodyA, bodyB)
+	expectStat(t, c, "diffing.match", 1)
+	expectStat(t, c, "diffing.diff", 0)
+}
+
+func TestNormalizerApply(t *testing.T) {
+	for _, tc := range []struct {
+		normalizer, in, out string
+		count               int
+	}{
+		{`s/x/y/`, "x x", "y x", 1},
+		{`s/x/y/g`, "x x", "y y", 2},
+		{`s/x/$USD/g`, "x x", "$USD $USD", 2},
+		{`s/(a)(b)/\2\1/g`, "abab", "baba", 2},
+		{`s/a/\\/`, "a", `\`, 1},
+		{`s|a/b|c|`, "a/b", "c", 1},
+		{`s/z/y/g`, "x x", "x x", 0},
+	} {
+		n, err := parseNormalizer(tc.normalizer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, count := n.apply(tc.in); out != tc.out || count != tc.count {
+			t.Errorf("%s on %q: expected %q (%d), got %q (%d)", tc.normalizer, tc.in, tc.out, tc.count, out, count)
+		}
+	}
+}
+
+func TestNormalizerStats(t *testing.T) {
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	stats := NewStats(false, "", "")
+	d, err := newDiffReporter(mockSettings(true, false), stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after NormalizerList
+	before.Set("s/a/b/")
+	before.Set("s/c/d/")
+	after.Set("s/e/f/")
+	after.Set("s/a/b/")
+
+	if names := d.statsForNormalizers(before); strings.Join(names, ",") != "diffing.normalized.1,diffing.normalized.2" {
+		t.Errorf("unexpected stats %v", names)
+	}
+	// Reloaded normalizers keep their stats, and new ones are numbered after.
+	if names := d.statsForNormalizers(after); strings.Join(names, ",") != "diffing.normalized.3,diffing.normalized.1" {
+		t.Errorf("unexpected stats %v", names)
+	}
+
+	stats.Add("diffing.normalized.3", 1)
+	var metrics bytes.Buffer
+	stats.WritePrometheus(&metrics)
+	if !strings.Contains(metrics.String(), `diffing_normalized_total{normalizer="s/e/f/"} 1`) {
+		t.Errorf("expected new normalizer to be labelled:\n%s", metrics.String())
+	}
+}
+
+func TestHeaderLists(t *testing.T) {
+	m := mockSettings(true, false)
+	m.CompareHeaders = []string{"X-Diffmirror-Test"}
+
+	a := runOne(t, m, "headerA", "headerB", "body", "body")
+	expectStat(t, a, "diffing.diff", 1)
+	expectStat(t, a, "diffing.header.X-Diffmirror-Test", 1)
+
+	b := runOne(t, m, "header", "header", "body", "body")
+	expectStat(t, b, "diffing.match", 1)
+
+	m = mockSettings(false, false)
+	m.IgnoreHeaders = []string{"Date", "X-Diffmirror-Test"}
+	c := runOne(t, m, "headerA", "headerB", "body", "body")
+	expectStat(t, c, "diffing.match", 1)
+	expectStat(t, c, "diffing.diff", 0)
+}
+
+func runNoise(t *testing.T, s *Options, bodyA, bodyA2, bodyB string) *Stats {
+	a2 := server("header", bodyA2)
+	defer a2.Close()
+
+	s.NameA2 = "a2"
+	s.HostA2 = strings.Replace(a2.URL, "http://", "", -1)
+	return runOne(t, s, "header", "header", bodyA, bodyB)
+}
+
+func TestNoise(t *testing.T) {
+	m := mockSettings(true, false)
+	m.CompareMode = "json"
+
+	a := runNoise(t, m, `{"t": 1, "v": 1}`, `{"t": 2, "v": 1}`, `{"t": 3, "v": 1}`)
+	expectStat(t, a, "diffing.noise", 1)
+	expectStat(t, a, "diffing.diff", 0)
+
+	b := runNoise(t, m, `{"t": 1, "v": 1}`, `{"t": 2, "v": 1}`, `{"t": 3, "v": 2}`)
+	expectStat(t, b, "diffing.noise", 0)
+	expectStat(t, b, "diffing.diff", 1)
+	expectStat(t, b, "diffing.path.$.v", 1)
+	expectStat(t, b, "diffing.path.$.t", 0)
+
+	// Payloads compared as a whole cannot tell which differences are noise.
+	m = mockSettings(true, false)
+	m.HostA, m.HostB = "localhost:8080", "localhost:8081"
+	m.HostA2 = "localhost:8082"
+	if _, err := New(m); err == nil || !strings.Contains(err.Error(), "noise-host requires comparing structurally") {
+		t.Errorf("expected error for noise-host when comparing bytes, got %v", err)
+	}
+
+	// Nor is an error from B, however much the copies of A differ.
+	m = mockSettings(true, false)
+	m.CompareMode = "json"
+	hostA := server("header", `{"t": 1}`)
+	defer hostA.Close()
+	hostA2 := server("header", `{"t": 2}`)
+	defer hostA2.Close()
+	hostB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer hostB.Close()
+	m.NameA2, m.HostA2 = "a2", hostA2.URL
+	e := mirrorOne(t, m, hostA.URL, hostB.URL)
+	expectStat(t, e, "diffing.noise", 0)
+	expectStat(t, e, "diffing.diff", 1)
+}
+
+func TestReplayPaused(t *testing.T) {
+	a := server("header", "body")
+	defer a.Close()
+	b := server("header", "body")
+	defer b.Close()
+
+	path := writeRequests(t, 3)
+
+	s := mockSettings(true, false)
+	s.HostA, s.HostB = a.URL, b.URL
+	m := mustNew(t, s)
+	defer m.Close()
+
+	m.Pause()
+	replayed := make(chan error)
+	go func() { replayed <- m.Replay(path) }()
+
+	select {
+	case err := <-replayed:
+		t.Fatalf("expected replay to wait while paused, finished with %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	expectStat(t, m.Stats(), "diffing.total", 0)
+
+	m.Resume()
+	if err := <-replayed; err != nil {
+		t.Fatal(err)
+	}
+	expectStat(t, m.Stats(), "diffing.match", 3)
+	expectStat(t, m.Stats(), "mirror.paused", 0)
+	if v := m.Verdict(); !v.Pass {
+		t.Errorf("expected verdict to pass, got %+v", v)
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	m := replayAll(t, mockSettings(true, false), "body", "body", 3)
+	expectStat(t, m.stats, "upstream.a.conn.new", 1)
+	expectStat(t, m.stats, "upstream.a.conn.reused", 2)
+	expectStat(t, m.stats, "upstream.b.conn.new", 1)
+	expectStat(t, m.stats, "upstream.b.conn.reused", 2)
+}
+
+func mirrorOne(t *testing.T, s *Options, hostA, hostB string) *Stats {
+	s.NameA, s.HostA = "a", hostA
+	s.NameB, s.HostB = "b", hostB
+	m := mustNew(t, s)
+
+	diffmirror := httptest.NewServer(m.Handler())
+	defer diffmirror.Close()
+
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	if _, err := http.Get(diffmirror.URL); err != nil {
+		t.Fatal(err)
+	}
+	m.Wait()
+	return m.stats
+}
+
+func TestTLSUpstream(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "body")
+	})
+	a := httptest.NewTLSServer(handler)
+	defer a.Close()
+	b := httptest.NewTLSServer(handler)
+	defer b.Close()
+
+	untrusted := mirrorOne(t, mockSettings(true, false), a.URL, b.URL)
+	expectStat(t, untrusted, "diffing.err.a", 1)
+	expectStat(t, untrusted, "diffing.err.b", 1)
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	var certs []byte
+	for _, srv := range []*httptest.Server{a, b} {
+		certs = append(certs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})...)
+	}
+	if err := ioutil.WriteFile(ca, certs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := mockSettings(true, false)
+	s.UpstreamCA = ca
+	trusted := mirrorOne(t, s, a.URL, b.URL)
+	expectStat(t, trusted, "diffing.match", 1)
+
+	s = mockSettings(true, false)
+	s.InsecureSkipVerify = true
+	skipped := mirrorOne(t, s, a.URL, b.URL)
+	expectStat(t, skipped, "diffing.match", 1)
+}
+
+func TestTLSListener(t *testing.T) {
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+	}
+	a := httptest.NewServer(http.HandlerFunc(echo))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(echo))
+	defer b.Close()
+
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	s := mockSettings(true, false)
+	s.ProxyPrimary = true
+	s.NameA, s.HostA = "a", a.URL
+	s.NameB, s.HostB = "b", b.URL
+	m := mustNew(t, s)
+
+	diffmirror := httptest.NewUnstartedServer(m.Handler())
+	diffmirror.EnableHTTP2 = true
+	diffmirror.StartTLS()
+	defer diffmirror.Close()
+
+	resp, err := diffmirror.Client().Post(diffmirror.URL+"/foo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	m.Wait()
+
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+	if string(body) != "POST /foo hello" {
+		t.Errorf("unexpected response %q", body)
+	}
+	expectStat(t, m.stats, "diffing.match", 1)
+}
+
+func TestH2CUpstream(t *testing.T) {
+	protos := make(chan int, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.ProtoMajor
+		w.Header().Set("X-diffmirror-test", "header")
+		fmt.Fprintln(w, "body")
+	})
+
+	a := httptest.NewServer(handler)
+	defer a.Close()
+
+	b := httptest.NewUnstartedServer(handler)
+	b.Config.Protocols = new(http.Protocols)
+	b.Config.Protocols.SetUnencryptedHTTP2(true)
+	b.Start()
+	defer b.Close()
+
+	s := mockSettings(false, false)
+	s.ProtoB = "h2"
+	stats := mirrorOne(t, s, a.URL, b.URL)
+	expectStat(t, stats, "diffing.match", 1)
+	expectStat(t, stats, "diffing.diff", 0)
+
+	if p := <-protos + <-protos; p != 3 {
+		t.Errorf("expected one HTTP/1.1 and one HTTP/2 request")
+	}
+}
+
+// grpcServer serves test.Svc/Get over h2c, replying with a test.Reply.
+func grpcServer(t *testing.T, status, name string, count int32) *httptest.Server {
+	desc := testDescriptors(t)
+	reply, _ := desc.FindDescriptorByName("test.Reply")
+
+	msg := dynamicpb.NewMessage(reply.(protoreflect.MessageDescriptor))
+	fields := msg.Descriptor().Fields()
+	msg.Set(fields.ByName("name"), protoreflect.ValueOfString(name))
+	msg.Set(fields.ByName("count"), protoreflect.ValueOfInt32(count))
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		frame := []byte{0, 0, 0, 0, byte(len(raw))}
+		w.Write(append(frame, raw...))
+		w.Header().Set("Grpc-Status", status)
+	}))
+	s.Config.Protocols = new(http.Protocols)
+	s.Config.Protocols.SetUnencryptedHTTP2(true)
+	s.Start()
+	return s
+}
+
+func testDescriptors(t *testing.T) *protoregistry.Files {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Reply"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("name"), JsonName: proto.String("name"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+				{Name: proto.String("count"), JsonName: proto.String("count"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+			},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Svc"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				{Name: proto.String("Get"), InputType: proto.String(".test.Reply"), OutputType: proto.String(".test.Reply")},
+			},
+		}},
+	}
+
+	raw, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.pb")
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := loadDescriptors(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func runGRPC(t *testing.T, s *Options, a, b *httptest.Server) *Stats {
+	defer a.Close()
+	defer b.Close()
+
+	s.GRPC = true
+	s.Bucketer = &GRPCMethodBucketer{}
+	s.ProtoA, s.ProtoB = "h2", "h2"
+	s.NameA, s.HostA = "a", a.URL
+	s.NameB, s.HostB = "b", b.URL
+	m := mustNew(t, s)
+
+	diffmirror := httptest.NewServer(m.Handler())
+	defer diffmirror.Close()
+
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	resp, err := http.Post(diffmirror.URL+"/test.Svc/Get", "application/grpc", strings.NewReader("\x00\x00\x00\x00\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("expected grpc reply, got trailers %v", resp.Trailer)
+	}
+
+	m.Wait()
+	return m.stats
+}
+
+func TestGRPC(t *testing.T) {
+	s := mockSettings(true, false)
+	s.Descriptors = testDescriptors(t)
+
+	same := runGRPC(t, s, grpcServer(t, "0", "x", 1), grpcServer(t, "0", "x", 1))
+	expectStat(t, same, "diffing.match", 1)
+	expectStat(t, same, "diffing.test.Svc/Get.match", 1)
+
+	diff := runGRPC(t, s, grpcServer(t, "0", "x", 1), grpcServer(t, "5", "x", 2))
+	expectStat(t, diff, "diffing.diff", 1)
+	expectStat(t, diff, "diffing.path.$.count", 1)
+	expectStat(t, diff, "diffing.path.status", 1)
+	expectStat(t, diff, "diffing.path.$.name", 0)
+
+	unavailable := runGRPC(t, s, grpcServer(t, "0", "x", 1), grpcServer(t, "14", "x", 1))
+	expectStat(t, unavailable, "diffing.err.b", 1)
+
+	s.IgnorePaths.Set("$.count")
+	ignored := runGRPC(t, s, grpcServer(t, "0", "x", 1), grpcServer(t, "0", "x", 2))
+	expectStat(t, ignored, "diffing.match", 1)
+
+	// Without descriptors, status codes are still compared, in whole
+	// responses or bodies alone.
+	for _, bodyOnly := range []bool{true, false} {
+		s = mockSettings(bodyOnly, false)
+		notFound := runGRPC(t, s, grpcServer(t, "0", "x", 1), grpcServer(t, "5", "x", 1))
+		expectStat(t, notFound, "diffing.diff", 1)
+		expectStat(t, notFound, "diffing.path.status", 1)
+		expectStat(t, notFound, "diffing.unknown-method", 0)
+	}
+
+	s = mockSettings(true, false)
+	s.GRPC = true
+	s.HostA, s.HostB = "a:80", "https://b:443"
+	s.ProtoB = "http1"
+	s.ProtoA = "http1"
+	if _, err := New(s); err == nil || !strings.Contains(err.Error(), "proto-a") {
+		t.Errorf("expected grpc over http1 to be rejected, got %v", err)
+	}
+	s.ProtoA = "h2"
+	if m, err := New(s); err != nil {
+		t.Errorf("expected grpc over h2c and https to be accepted, got %v", err)
+	} else {
+		m.Close()
+	}
+}
+
+func TestGRPCMessages(t *testing.T) {
+	compressed := encodeBody(t, "gzip", strings.Repeat("x", 100))
+	body := make([]byte, 5, 5+len(compressed))
+	body[0] = 1
+	binary.BigEndian.PutUint32(body[1:5], uint32(len(compressed)))
+	body = append(body, compressed...)
+
+	msgs, err := grpcMessages(body, "gzip", 1024)
+	if err != nil || len(msgs) != 1 || string(msgs[0]) != strings.Repeat("x", 100) {
+		t.Errorf("expected one message of 100 x's, got %q (%v)", msgs, err)
+	}
+
+	// Compressed messages are capped as bodies are.
+	if _, err := grpcMessages(body, "gzip", 10); err == nil || !strings.Contains(err.Error(), "more than 10 bytes") {
+		t.Errorf("expected error for message decompressing beyond the limit, got %v", err)
+	}
+
+	if _, err := grpcMessages(body, "snappy", 1024); err == nil {
+		t.Error("expected error for unsupported message encoding")
+	}
+}
+
+// thriftUser encodes a framed binary, or compact, protocol reply to getUser,
+// whose result is a User struct of {1: i32 id, 2: string name}.
+func thriftUser(compact bool, id int32, name string) string {
+	var b bytes.Buffer
+	if compact {
+		b.Write([]byte{0x82, thriftReply<<5 | 1, 1, 7})
+		b.WriteString("getUser")
+		b.Write([]byte{0x0c, 0})                    // field 0, struct
+		b.Write([]byte{0x15, byte(id<<1 ^ id>>31)}) // field 1, i32
+		b.Write([]byte{0x18, byte(len(name))})      // field 2, binary
+		b.WriteString(name)
+		b.Write([]byte{0, 0})
+		return b.String()
+	}
+
+	b.Write([]byte{0, 0, 0, 0, 0x80, 1, 0, thriftReply, 0, 0, 0, 7})
+	b.WriteString("getUser")
+	b.Write([]byte{0, 0, 0, 1})
+	b.Write([]byte{12, 0, 0})
+	b.Write([]byte{8, 0, 1})
+	binary.Write(&b, binary.BigEndian, id)
+	b.Write([]byte{11, 0, 2})
+	binary.Write(&b, binary.BigEndian, int32(len(name)))
+	b.WriteString(name)
+	b.Write([]byte{0, 0})
+
+	framed := b.Bytes()
+	binary.BigEndian.PutUint32(framed, uint32(len(framed)-4))
+	return string(framed)
+}
+
+func TestThriftDecode(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		msg, err := readThriftMessage([]byte(thriftUser(compact, 7, "bob")), compact, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.name != "getUser" || msg.typ != thriftReply || msg.seqID != 1 {
+			t.Errorf("unexpected envelope %q %d %d", msg.name, msg.typ, msg.seqID)
+		}
+		body, _ := json.Marshal(msg.body)
+		if expected := `{"0":{"1":7,"2":"bob"}}`; string(body) != expected {
+			t.Errorf("expected %s, got %s", expected, body)
+		}
+	}
+
+	if _, err := readThriftMessage([]byte(thriftUser(false, 7, "bob"))[:20], false, false); err == nil {
+		t.Error("expected error decoding truncated message")
+	}
+
+	if _, err := readThriftMessage(thriftNestedLists(10), false, false); err != nil {
+		t.Errorf("expected nested lists to decode, got %v", err)
+	}
+	if _, err := readThriftMessage(thriftNestedLists(100000), false, false); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("expected error decoding deeply nested lists, got %v", err)
+	}
+}
+
+// thriftNestedLists encodes a binary protocol reply whose only field is a
+// list nested in lists depth times.
+func thriftNestedLists(depth int) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0x80, 1, 0, thriftReply, 0, 0, 0, 4})
+	b.WriteString("ping")
+	b.Write([]byte{0, 0, 0, 1})
+	b.Write([]byte{15, 0, 0})
+	for i := 1; i < depth; i++ {
+		b.Write([]byte{15, 0, 0, 0, 1})
+	}
+	b.Write([]byte{8, 0, 0, 0, 0})
+	b.Write([]byte{0})
+	return b.Bytes()
+}
+
+func thriftServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-thrift")
+		io.WriteString(w, body)
+	}))
+}
+
+func runThrift(t *testing.T, s *Options, bodyA, bodyB string) *Stats {
+	a := thriftServer(bodyA)
+	defer a.Close()
+	b := thriftServer(bodyB)
+	defer b.Close()
+	return mirrorOne(t, s, a.Listener.Addr().String(), b.Listener.Addr().String())
+}
+
+func TestThrift(t *testing.T) {
+	for _, protocol := range []string{"binary", "compact"} {
+		compact := protocol == "compact"
+
+		m := mockSettings(true, false)
+		m.Thrift = protocol
+
+		same := runThrift(t, m, thriftUser(compact, 7, "bob"), thriftUser(compact, 7, "bob"))
+		expectStat(t, same, "diffing.match", 1)
+
+		diff := runThrift(t, m, thriftUser(compact, 7, "bob"), thriftUser(compact, 7, "rob"))
+		expectStat(t, diff, "diffing.diff", 1)
+		expectStat(t, diff, "diffing.invalid-thrift", 0)
+		expectStat(t, diff, "diffing.path.$.0.2", 1)
+		expectStat(t, diff, "diffing.path.$.0.1", 0)
+	}
+
+	for _, compact := range []bool{false, true} {
+		bucketer := &ThriftMethodBucketer{Compact: compact}
+		if bucket := bucketer.Bucket(nil, []byte(thriftUser(compact, 1, "x"))); bucket != "getUser" {
+			t.Errorf("expected bucket getUser, got %q (compact: %v)", bucket, compact)
+		}
+	}
+}
+
+func encodeBody(t *testing.T, encoding, body string) string {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		var err error
+		if w, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		return body
+	}
+	io.WriteString(w, body)
+	w.Close()
+	return buf.String()
+}
+
+func encodedServer(t *testing.T, encoding, body string) *httptest.Server {
+	encoded := encodeBody(t, encoding, body)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		io.WriteString(w, encoded)
+	}))
+}
+
+func TestDecodeBody(t *testing.T) {
+	for _, encoding := range []string{"", "gzip", "deflate", "br", "zstd"} {
+		decoded, err := decodeBody(encoding, []byte(encodeBody(t, encoding, "hello")), 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded) != "hello" {
+			t.Errorf("%s: expected hello, got %q", encoding, decoded)
+		}
+	}
+
+	twice := encodeBody(t, "br", encodeBody(t, "gzip", "hello"))
+	if decoded, err := decodeBody("gzip, br", []byte(twice), 1024); err != nil || string(decoded) != "hello" {
+		t.Errorf("expected hello, got %q (%v)", decoded, err)
+	}
+
+	if _, err := decodeBody("compress", []byte("hello"), 1024); err == nil {
+		t.Error("expected error for unsupported encoding")
+	}
+
+	bomb := encodeBody(t, "gzip", strings.Repeat("\x00", 1024*1024))
+	if _, err := decodeBody("gzip", []byte(bomb), 1024); err == nil || !strings.Contains(err.Error(), "more than 1024 bytes") {
+		t.Errorf("expected error for body decoding to more than the limit, got %v", err)
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	for _, bodyOnly := range []bool{true, false} {
+		m := mockSettings(bodyOnly, false)
+
+		// Bodies are compared decoded, and the encoding only counted.
+		a := encodedServer(t, "gzip", "hello")
+		b := encodedServer(t, "", "hello")
+		same := mirrorOne(t, m, a.Listener.Addr().String(), b.Listener.Addr().String())
+		a.Close()
+		b.Close()
+		expectStat(t, same, "diffing.match", 1)
+		expectStat(t, same, "diffing.encoding-differs", 1)
+
+		// Unless Content-Encoding is compared explicitly.
+		m = mockSettings(bodyOnly, false)
+		m.CompareHeaders = []string{"Content-Encoding"}
+		a = encodedServer(t, "gzip", "hello")
+		b = encodedServer(t, "br", "hello")
+		encoding := mirrorOne(t, m, a.Listener.Addr().String(), b.Listener.Addr().String())
+		a.Close()
+		b.Close()
+		expectStat(t, encoding, "diffing.diff", 1)
+		expectStat(t, encoding, "diffing.encoding-differs", 1)
+		expectStat(t, encoding, "diffing.header.Content-Encoding", 1)
+
+		m = mockSettings(bodyOnly, false)
+		m.IgnoreHeaders = append(m.IgnoreHeaders, "Content-Encoding")
+		a = encodedServer(t, "gzip", "hello")
+		b = encodedServer(t, "br", "hello")
+		same = mirrorOne(t, m, a.Listener.Addr().String(), b.Listener.Addr().String())
+		a.Close()
+		b.Close()
+		expectStat(t, same, "diffing.match", 1)
+		expectStat(t, same, "diffing.encoding-differs", 1)
+
+		a = encodedServer(t, "zstd", "hello")
+		b = encodedServer(t, "", "goodbye")
+		diff := mirrorOne(t, m, a.Listener.Addr().String(), b.Listener.Addr().String())
+		a.Close()
+		b.Close()
+		expectStat(t, diff, "diffing.diff", 1)
+	}
+}
+
+type recordingSink struct {
+	diffs    []*Diff
+	closed   bool
+	closeErr error
+}
+
+func (s *recordingSink) Diff(d *Diff) { s.diffs = append(s.diffs, d) }
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return s.closeErr
+}
+
+func TestSubmit(t *testing.T) {
+	a := server("header", "bodyA")
+	defer a.Close()
+	b := server("header", "bodyB")
+	defer b.Close()
+
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	sink := new(recordingSink)
+	s := mockSettings(true, false)
+	s.HostA, s.HostB = a.URL, b.URL
+	s.Sinks = []Sink{sink}
+	m := mustNew(t, s)
+
+	for _, path := range []string{"/one", "/two"} {
+		req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		raw, err := httputil.DumpRequestOut(req, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Submit(raw)
+	}
+	m.Close()
+
+	expectStat(t, m.Stats(), "diffing.diff", 2)
+	if len(sink.diffs) != 2 || !sink.closed {
+		t.Fatalf("expected 2 diffs and a closed sink, got %d (closed: %v)", len(sink.diffs), sink.closed)
+	}
+	if d := sink.diffs[0]; d.NameA != "a" || string(d.A.Body()) != "bodyA\n" {
+		t.Errorf("unexpected diff %+v", d)
+	}
+
+	s = DefaultOptions()
+	s.HostA = a.URL
+	if _, err := New(s); err == nil {
+		t.Error("expected error for missing hostB")
+	}
+
+	// Nothing is left running if New fails.
+	before := runtime.NumGoroutine()
+	s = mockSettings(true, false)
+	s.HostA, s.HostB = a.URL, b.URL
+	s.PrintStats = true
+	s.RequestsFile = filepath.Join(t.TempDir(), "requests.gor")
+	s.ComparatorServer = "testing/does-not-exist"
+	if _, err := New(s); err == nil {
+		t.Error("expected error for missing comparator server")
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("expected no goroutines left running, went from %d to %d", before, after)
+	}
+
+	sink = &recordingSink{closeErr: fmt.Errorf("disk full")}
+	s = mockSettings(true, false)
+	s.HostA, s.HostB = a.URL, b.URL
+	s.Sinks = []Sink{sink}
+	if err := mustNew(t, s).Close(); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("expected error closing sink, got %v", err)
+	}
+
+	// Nor once it is closed, including connections to the hosts and stats
+	// reporting.
+	before = runtime.NumGoroutine()
+	s = mockSettings(true, false)
+	s.HostA, s.HostB = a.URL, b.URL
+	s.PrintStats = true
+	s.GraphiteHost = "127.0.0.1:2003"
+	m = mustNew(t, s)
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	raw, err := httputil.DumpRequestOut(req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Submit(raw)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); after > before && time.Now().Before(deadline); after = runtime.NumGoroutine() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after > before {
+		t.Errorf("expected no goroutines left running after Close, went from %d to %d", before, after)
+	}
+}
+
+func TestInvalidRequest(t *testing.T) {
+	a := server("header", "body")
+	defer a.Close()
+	b := server("header", "body")
+	defer b.Close()
+
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	s := mockSettings(true, false)
+	s.HostA, s.HostB = a.URL, b.URL
+	m := mustNew(t, s)
+
+	m.Submit([]byte("not a request"))
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	raw, err := httputil.DumpRequestOut(req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Submit(raw)
+	m.Close()
+
+	expectStat(t, m.Stats(), "mirror.invalid-request", 1)
+	expectStat(t, m.Stats(), "diffing.total", 1)
+	expectStat(t, m.Stats(), "diffing.match", 1)
+}
+
+func TestReload(t *testing.T) {
+	a := server("header", `{"a": 1, "b": 2}`)
+	defer a.Close()
+	b := server("header", `{"b": 2, "a": 1}`)
+	defer b.Close()
+
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	s := mockSettings(true, false)
+	s.HostA, s.HostB = a.URL, b.URL
+	m := mustNew(t, s)
+	defer m.Close()
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	raw, err := httputil.DumpRequestOut(req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Submit(raw)
+	m.Wait()
+	expectStat(t, m.Stats(), "diffing.diff", 1)
+
+	reloaded := mockSettings(true, false)
+	reloaded.HostA, reloaded.HostB = a.URL, b.URL
+	reloaded.CompareMode = "json"
+	reloaded.Workers = 5
+	if err := m.Reload(reloaded); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Submit(raw)
+	m.Wait()
+	expectStat(t, m.Stats(), "diffing.total", 2)
+	expectStat(t, m.Stats(), "diffing.match", 1)
+
+	if changes := optionChanges(s, m.current.Load().settings); len(changes) != 1 || changes[0] != `CompareMode: "bytes" -> "json"` {
+		t.Errorf("unexpected changes %q", changes)
+	}
+
+	reloaded.CompareMode = "xml"
+	if err := m.Reload(reloaded); err == nil {
+		t.Error("expected error for unknown comparison mode")
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	a := server("header", "bodyA")
+	defer a.Close()
+	b := server("header", "bodyB")
+	defer b.Close()
+
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	s := mockSettings(true, false)
+	s.HostA, s.HostB = a.URL, b.URL
+	s.Bucketer = constBucketer("search")
+	s.RequestsFile = filepath.Join(t.TempDir(), "requests.gor")
+	m := mustNew(t, s)
+	defer m.Close()
+
+	admin := httptest.NewServer(m.AdminHandler())
+	defer admin.Close()
+
+	get := func(path string, v interface{}) {
+		resp, err := http.Get(admin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+	}
+	post := func(path string) {
+		resp, err := http.Post(admin.URL+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %s", path, resp.Status)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/search", nil)
+	raw, err := httputil.DumpRequestOut(req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Submit(raw)
+	m.Wait()
+
+	var buckets map[string]bucketCounts
+	get("/buckets", &buckets)
+	if c := buckets["search"]; c.Total != 1 || c.Diff != 1 || c.DiffRate != 1 {
+		t.Errorf("unexpected bucket counts %+v", buckets)
+	}
+
+	var diffs []diffLogEntry
+	get("/diffs", &diffs)
+	if len(diffs) != 1 || diffs[0].URI != "/search" || string(diffs[0].B.Body) != "bodyB\n" {
+		t.Errorf("unexpected diffs %+v", diffs)
+	}
+
+	var stats map[string]map[string]interface{}
+	get("/stats", &stats)
+	if stats["diffing.diff"]["count"] != 1.0 {
+		t.Errorf("unexpected stats %v", stats["diffing.diff"])
+	}
+
+	post("/pause")
+	m.Submit(raw)
+	m.Wait()
+	expectStat(t, m.Stats(), "mirror.paused", 1)
+	if v := m.Verdict(); v.Pass {
+		t.Errorf("expected requests ignored while paused to fail the verdict, got %+v", v)
+	}
+
+	var queue map[string]interface{}
+	get("/queue", &queue)
+	if queue["paused"] != true || queue["depth"] != 0.0 {
+		t.Errorf("unexpected queue %v", queue)
+	}
+
+	post("/resume")
+	post("/sample-rate?rate=0%25")
+	m.Submit(raw)
+	m.Wait()
+	expectStat(t, m.Stats(), "mirror.sampled-out", 1)
+
+	var settings map[string]interface{}
+	get("/settings", &settings)
+	if settings["SampleRate"] != "0%" || settings["CompareMode"] != "bytes" {
+		t.Errorf("unexpected settings %v", settings)
+	}
+
+	post("/flush")
+
+	if resp, err := http.Get(admin.URL + "/pause"); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET /pause to be rejected, got %v (%v)", resp, err)
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	a := server("header", "bodyA")
+	defer a.Close()
+	b := server("header", "bodyB")
+	defer b.Close()
+
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	s := mockSettings(true, false)
+	s.HostA, s.HostB = a.URL, b.URL
+	s.Bucketer = constBucketer("search")
+	m := mustNew(t, s)
+	defer m.Close()
+
+	admin := httptest.NewServer(m.AdminHandler())
+	defer admin.Close()
+
+	req, _ := http.NewRequest("GET", "http://example.com/search", nil)
+	raw, err := httputil.DumpRequestOut(req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Submit(raw)
+	m.Wait()
+
+	resp, err := http.Get(admin.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := string(body)
+
+	for _, expected := range []string{
+		"# TYPE diffing_diffs_total counter\ndiffing_diffs_total 1\n",
+		"\ndiffing_bucket_diffs_total{bucket=\"search\"} 1\n",
+		"\nmirror_bucket_requests_total{bucket=\"search\"} 1\n",
+		"\nmirror_requests_total 1\n",
+		"# TYPE diffing_rtt_seconds summary\n",
+		"\ndiffing_bucket_rtt_seconds_count{bucket=\"search\",host=\"a\"} 1\n",
+		"\ndiffing_rtt_seconds{host=\"b\",quantile=\"0.99\"} ",
+		"\nupstream_conns_new_total{host=\"a\"} 1\n",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("expected %q in:\n%s", expected, metrics)
+		}
+	}
+	if strings.Contains(metrics, "diffing_search") {
+		t.Errorf("expected bucket to be a label, not part of a name:\n%s", metrics)
+	}
+}
+
+func TestPromLabels(t *testing.T) {
+	if s := promLabels([]string{"path", `a"b\c` + "\n"}); s != `{path="a\"b\\c\n"}` {
+		t.Errorf("unexpected labels %s", s)
+	}
+	if s := promName("mirror.ignored-bucket"); s != "mirror_ignored_bucket" {
+		t.Errorf("unexpected name %s", s)
+	}
+}
@@ -1,113 +1,315 @@
-package main
+package diffmirror
 
 import (
 	"bufio"
 	"bytes"
 	"log"
+	"math/rand"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// A Mirror sends each request submitted to it to two hosts, comparing their
+// responses.
 type Mirror struct {
-	settings *Settings
+	// The options given to New. Those which can be reloaded are read from
+	// the current snapshot instead.
+	settings *Options
 
-	queue    chan []byte
-	reporter *DiffReporter
+	current    atomic.Pointer[snapshot]
+	reloadLock sync.Mutex
+
+	// Closes resumed when mirroring is resumed.
+	pauseLock sync.Mutex
+	paused    atomic.Bool
+	resumed   chan struct{}
+
+	queue    chan *mirrorReq
+	reporter *diffReporter
 	stats    *Stats
 
+	a, a2, b *upstream
+
 	working *sync.WaitGroup
 }
 
-func NewMirror(s *Settings) *Mirror {
+// New starts a Mirror's workers. The options are not used once it returns.
+func New(o *Options) (*Mirror, error) {
+	given := new(Options)
+	*given = *o
+	s := new(Options)
+	*s = *o
+	if err := s.prepare(); err != nil {
+		return nil, err
+	}
+
 	m := new(Mirror)
 	m.settings = s
 
-	m.queue = make(chan []byte, 100)
+	m.queue = make(chan *mirrorReq, 100)
 
-	m.stats = NewStats(s.printStats, s.graphiteHost, s.graphitePrefix)
-	m.reporter = NewDiffReporter(s, m.stats)
+	// Nothing is started until every step that may fail has succeeded, so a
+	// failure leaves nothing running: upstreams connect when first used, and
+	// the reporter closes whatever it opened if it fails.
+	m.stats = newStats()
 
-	for i := 0; i < s.workers; i++ {
+	var err error
+	if m.a, err = newUpstream(s.NameA, s.HostA, s.ProtoA, s, m.stats); err != nil {
+		return nil, err
+	}
+	if m.b, err = newUpstream(s.NameB, s.HostB, s.ProtoB, s, m.stats); err != nil {
+		return nil, err
+	}
+	if s.HostA2 != "" {
+		if m.a2, err = newUpstream(s.NameA2, s.HostA2, s.ProtoA2, s, m.stats); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.reporter, err = newDiffReporter(s, m.stats); err != nil {
+		return nil, err
+	}
+	m.current.Store(m.reporter.snapshot(given, s))
+
+	m.stats.report(s.PrintStats, s.GraphiteHost, s.GraphitePrefix)
+
+	m.working = new(sync.WaitGroup)
+
+	for i := 0; i < s.Workers; i++ {
 		go m.worker()
 	}
 
-	if s.trackWork {
-		m.working = new(sync.WaitGroup)
+	return m, nil
+}
+
+// Submit queues a raw HTTP request, as gor records them, to be mirrored,
+// waiting for room in the queue if it is full. Requests which cannot be parsed
+// are counted in mirror.invalid-request.
+func (m *Mirror) Submit(raw []byte) {
+	m.begin()
+	m.queue <- &mirrorReq{raw: raw}
+}
+
+// submitReplayed queues a request as Submit does, but one which waits while
+// mirroring is paused, rather than being ignored, so that pausing a replay
+// holds up, rather than discards, what remains of it.
+func (m *Mirror) submitReplayed(raw []byte) {
+	m.begin()
+	m.queue <- &mirrorReq{raw: raw, waitIfPaused: true}
+}
+
+// Wait blocks until every request submitted so far has been compared.
+func (m *Mirror) Wait() {
+	m.working.Wait()
+}
+
+// Close waits for submitted requests to be compared, then stops the workers
+// and stats reporting, closes idle connections to the hosts and flushes the
+// sinks, returning the first error closing one. Nothing may be submitted after
+// Close.
+func (m *Mirror) Close() error {
+	m.working.Wait()
+	close(m.queue)
+	m.stats.stopReporting()
+	for _, u := range []*upstream{m.a, m.a2, m.b} {
+		if u != nil {
+			u.close()
+		}
 	}
+	return m.reporter.Close()
+}
+
+// Handler returns an http.Handler mirroring every request it receives.
+func (m *Mirror) Handler() http.Handler {
+	return MirrorServer{mirror: m}
+}
+
+func (m *Mirror) Stats() *Stats {
+	return m.stats
+}
+
+// Verdict checks the results so far against the thresholds set.
+func (m *Mirror) Verdict() *Verdict {
+	return m.reporter.Verdict()
+}
+
+// PrintSummary logs how many requests matched, differed and errored.
+func (m *Mirror) PrintSummary() {
+	m.reporter.PrintSummary()
+}
 
-	return m
+// A request waiting to be mirrored. In proxy-primary mode, resA is the
+// response already returned to the client by host A, captured with snap.
+type mirrorReq struct {
+	raw  []byte
+	resA *MirrorResp
+	snap *snapshot
+	// Whether to wait, rather than be ignored, while mirroring is paused.
+	waitIfPaused bool
 }
 
 type MirrorResp struct {
-	status  int
-	err     error
+	// For gRPC responses, the gRPC status code rather than the HTTP status.
+	status int
+	grpc   bool
+
+	header http.Header
+	body   []byte
+	err    error
+	rtt    time.Duration
+	dial   time.Duration
+
+	// The Content-Encoding the body was sent with, before it was decoded.
+	encoding string
+
+	// What is actually compared: either the body or the whole dumped response.
 	payload string
-	rtt     time.Duration
 }
 
+// The status code: for gRPC responses, the gRPC status code.
+func (m *MirrorResp) Status() int { return m.status }
+
+func (m *MirrorResp) Header() http.Header { return m.header }
+
+// The body, decoded according to its Content-Encoding.
+func (m *MirrorResp) Body() []byte { return m.body }
+
+// What is compared byte-for-byte: either the body or the whole response.
+func (m *MirrorResp) Payload() string { return m.payload }
+
+// Any error sending the request or reading the response.
+func (m *MirrorResp) Err() error { return m.err }
+
+func (m *MirrorResp) RTT() time.Duration { return m.rtt }
+
 func (m *MirrorResp) isErr() bool {
+	if m.grpc {
+		return m.err != nil || grpcErrorCodes[m.status]
+	}
 	return m.err != nil || m.status/100 == 5
 }
 
 func (m *Mirror) worker() {
-	for {
-		m.unpackAndHandle(<-m.queue)
+	for r := range m.queue {
+		m.unpackAndHandle(r)
+	}
+}
+
+// begin marks a request as in flight, so that waiting on working covers it
+// from the moment it arrives rather than when a worker picks it up.
+func (m *Mirror) begin() {
+	m.working.Add(1)
+}
+
+func (m *Mirror) done() {
+	m.working.Done()
+}
+
+// enqueue hands a request, previously passed to begin, to the workers.
+func (m *Mirror) enqueue(r *mirrorReq) {
+	select {
+	case m.queue <- r:
+		m.stats.Gauge("mirror.queue", len(m.queue))
+	default:
+		m.stats.Inc("mirror.dropped")
+		m.done()
 	}
 }
 
-func (m *Mirror) unpackAndHandle(raw []byte) {
-	if m.working != nil {
-		m.working.Add(1)
-		defer m.working.Done()
+func (m *Mirror) unpackAndHandle(r *mirrorReq) {
+	defer m.done()
+
+	raw := r.raw
+
+	if m.paused.Load() {
+		if !r.waitIfPaused {
+			m.stats.Inc("mirror.paused")
+			return
+		}
+		m.waitUntilResumed()
+	}
+
+	snap := r.snap
+	if snap == nil {
+		snap = m.current.Load()
 	}
+	s := snap.settings
 
 	m.stats.Inc("mirror.requests")
 
-	reqA, _ := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	reqA, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		log.Printf("Invalid request: %v", err)
+		m.stats.Inc("mirror.invalid-request")
+		return
+	}
 	reqB, _ := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
 
 	bucket := ""
-	if m.settings.bucketer != nil {
+	if s.Bucketer != nil {
 		crlfcrlf := []byte("\r\n\r\n")
 		e := bytes.Index(raw, crlfcrlf)
 		if e > -1 {
-			bucket = m.settings.bucketer.Bucket(reqA, raw[e+len(crlfcrlf):])
+			bucket = s.Bucketer.Bucket(reqA, raw[e+len(crlfcrlf):])
 		}
 	}
 
-	if m.settings.requireBucket != "" && bucket != m.settings.requireBucket {
+	if s.RequireBucket != "" && bucket != s.RequireBucket {
 		m.stats.Inc("mirror.ignored-bucket")
 		return
 	}
 
-	if m.settings.excludeBucket != "" && bucket == m.settings.excludeBucket {
+	if s.ExcludeBucket != "" && bucket == s.ExcludeBucket {
 		m.stats.Inc("mirror.ignored-bucket")
 		return
 	}
 
+	if rate := s.forBucket(bucket).SampleRate; rate < 1 && rand.Float64() >= float64(rate) {
+		m.stats.Inc("mirror.sampled-out")
+		return
+	}
+
 	if bucket != "" {
 		// TODO(davidt): Memoize concated string to avoid allocations
+		m.stats.Label("mirror.requests-"+bucket, "mirror_bucket_requests", "bucket", bucket)
 		m.stats.Inc("mirror.requests-" + bucket)
 	}
 
 	start := time.Now()
-	m.mirror(reqA, reqB, raw, bucket)
+	m.mirror(snap, reqA, reqB, raw, bucket, r.resA)
 	end := time.Now()
 
 	m.stats.Timing("mirror.time", end.Sub(start))
 }
 
-func (m *Mirror) mirror(reqA, reqB *http.Request, raw []byte, bucket string) {
-	backA := make(chan *MirrorResp)
+func (m *Mirror) mirror(snap *snapshot, reqA, reqB *http.Request, raw []byte, bucket string, resA *MirrorResp) {
+	s := snap.settings
+
 	backB := make(chan *MirrorResp)
+	go m.b.asyncSend(backB, reqB, s)
 
-	go asyncSend(backA, reqA, m.settings.hostA, m.settings.compareBodyOnly)
-	go asyncSend(backB, reqB, m.settings.hostB, m.settings.compareBodyOnly)
+	var backA2 chan *MirrorResp
+	if m.a2 != nil {
+		reqA2, _ := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+		backA2 = make(chan *MirrorResp)
+		go m.a2.asyncSend(backA2, reqA2, s)
+	}
 
-	resA := <-backA
+	if resA == nil {
+		resA = m.a.send(reqA, s)
+	}
 	resB := <-backB
 
+	var resA2 *MirrorResp
+	if backA2 != nil {
+		resA2 = <-backA2
+		if resA2.err != nil {
+			log.Printf("error mirroring request: %s", resA2.err)
+		}
+	}
+
 	if resA.err != nil {
 		log.Printf("error mirroring request: %s", resA.err)
 	}
@@ -116,5 +318,5 @@ func (m *Mirror) mirror(reqA, reqB *http.Request, raw []byte, bucket string) {
 		log.Printf("error mirroring request: %s", resB.err)
 	}
 
-	m.reporter.Compare(reqA, raw, resA, resB, bucket)
+	m.reporter.Compare(snap, reqA, raw, resA, resA2, resB, bucket)
 }
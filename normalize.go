@@ -0,0 +1,139 @@
+package diffmirror
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A normalizer is a sed-style substitution, `s/pattern/replacement/`,
+// applied to payloads before they are compared. As in sed, only the first
+// match is replaced unless the g flag is given.
+type normalizer struct {
+	text   string
+	re     *regexp.Regexp
+	global bool
+	// The replacement, as a template for regexp.Expand.
+	repl string
+}
+
+func parseNormalizer(s string) (*normalizer, error) {
+	if len(s) < 2 || s[0] != 's' {
+		return nil, fmt.Errorf("normalizer %q must be of the form s/pattern/replacement/", s)
+	}
+	delim := s[1:2]
+
+	// Split on unescaped delimiters, unescaping escaped ones. An escaped
+	// backslash is kept as is.
+	var parts []string
+	var cur strings.Builder
+	rest := s[2:]
+	for i := 0; i < len(rest); i++ {
+		switch {
+		case rest[i] == '\\' && i+1 < len(rest) && rest[i+1:i+2] == delim:
+			cur.WriteString(delim)
+			i++
+		case rest[i] == '\\' && i+1 < len(rest) && rest[i+1] == '\\':
+			cur.WriteString(`\\`)
+			i++
+		case rest[i:i+1] == delim:
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(rest[i])
+		}
+	}
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("normalizer %q must be of the form s/pattern/replacement/", s)
+	}
+
+	pattern := parts[0]
+	global := false
+	for _, f := range cur.String() {
+		switch f {
+		case 'g':
+			global = true
+		case 'i':
+			pattern = "(?i)" + pattern
+		default:
+			return nil, fmt.Errorf("unknown flag %q in normalizer %q", f, s)
+		}
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern in normalizer %q: %s", s, err)
+	}
+
+	return &normalizer{
+		text:   s,
+		re:     re,
+		global: global,
+		repl:   sedTemplate(parts[1]),
+	}, nil
+}
+
+// sedTemplate converts a sed replacement, in which \1 to \9 refer to groups
+// and \\ is a backslash, to a template for regexp.Expand. Anything else,
+// including $, is literal.
+func sedTemplate(repl string) string {
+	var b strings.Builder
+	for i := 0; i < len(repl); i++ {
+		switch c := repl[i]; {
+		case c == '$':
+			b.WriteString("$$")
+		case c == '\\' && i+1 < len(repl) && repl[i+1] >= '0' && repl[i+1] <= '9':
+			b.WriteString("${" + repl[i+1:i+2] + "}")
+			i++
+		case c == '\\' && i+1 < len(repl) && repl[i+1] == '\\':
+			b.WriteByte('\\')
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// apply returns s with the first match, or every match if global, replaced,
+// and the number of replacements.
+func (n *normalizer) apply(s string) (string, int) {
+	limit := 1
+	if n.global {
+		limit = -1
+	}
+	matches := n.re.FindAllStringSubmatchIndex(s, limit)
+	if len(matches) == 0 {
+		return s, 0
+	}
+
+	var out []byte
+	last := 0
+	for _, m := range matches {
+		out = append(out, s[last:m[0]]...)
+		out = n.re.ExpandString(out, n.repl, s, m)
+		last = m[1]
+	}
+	out = append(out, s[last:]...)
+	return string(out), len(matches)
+}
+
+// A flag accepting any number of normalizers.
+type NormalizerList []*normalizer
+
+func (l *NormalizerList) String() string {
+	parts := make([]string, len(*l))
+	for i, n := range *l {
+		parts[i] = n.text
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *NormalizerList) Set(v string) error {
+	n, err := parseNormalizer(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, n)
+	return nil
+}
@@ -0,0 +1,324 @@
+package diffmirror
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// Options configure a Mirror. Start from DefaultOptions, as the zero value of
+// some fields is not their default.
+type Options struct {
+	// Number of requests mirrored at once.
+	Workers int
+
+	// Idle keep-alive connections to keep open to each host, and the most to
+	// open at once (0 for no limit).
+	MaxIdleConns int
+	MaxOpenConns int
+
+	// Verifying, and authenticating to, https hosts.
+	UpstreamCA         string
+	UpstreamCert       string
+	UpstreamKey        string
+	UpstreamServerName string
+	InsecureSkipVerify bool
+
+	// Hosts, optionally prefixed with http:// or https://, and the names
+	// they are reported under. HostA2, if set, runs the same build as HostA,
+	// and differences that also appear between the two are counted as noise.
+	HostA  string
+	NameA  string
+	HostA2 string
+	NameA2 string
+	HostB  string
+	NameB  string
+
+	// Protocol used to reach each host: "http1" or "h2".
+	ProtoA  string
+	ProtoA2 string
+	ProtoB  string
+
+	// Record stats only, without comparing responses.
+	SkipDiff bool
+	// Have the Handler forward requests to A and return its response,
+	// rather than replying OK.
+	ProxyPrimary bool
+
+	// A gor compatible file to record requests which produced diffs in.
+	RequestsFile string
+
+	// A file to append a json line describing each diff to, truncating
+	// bodies to DiffLogMaxBody bytes (0 for no limit).
+	DiffLog        string
+	DiffLogMaxBody int
+
+	// Thresholds checked by Verdict. Negative values are unset.
+	MaxDiffRate      Ratio
+	MaxErrorRate     Ratio
+	MaxP99Regression Ratio
+
+	IgnoreErrors    bool
+	CompareBodyOnly bool
+	CompareHeaders  []string
+	IgnoreHeaders   []string
+	// Deprecated: use UnorderedArrays.
+	IgnoreBodyOrder bool
+	CompareCmd      string
+	// "bytes", "json" or "status". gRPC and Thrift responses are compared
+	// by setting GRPC or Thrift instead.
+	CompareMode     string
+	IgnorePaths     SelectorList
+	UnorderedArrays SelectorList
+	ArrayKeys       SelectorList
+
+	ComparatorServer string
+	// How long to wait for the comparator server to respond before killing
+	// and restarting it.
+	ComparatorTimeout time.Duration
+
+	// Chains of comparators to use for each bucket, replacing those configured
+	// by other options. Those under "" are used for any other bucket.
+	Comparators map[string][]Comparator
+
+	// Fraction of requests to mirror.
+	SampleRate Ratio
+
+	// Policies overriding how requests in particular buckets are sampled and
+	// compared. Requires a Bucketer.
+	Buckets map[string]*BucketPolicy
+
+	// Sinks sent each diff, in addition to RequestsFile and DiffLog.
+	Sinks []Sink
+
+	FloatTolerance    float64
+	RelativeTolerance Ratio
+
+	GRPC bool
+	// A FileDescriptorSet file, or already loaded Descriptors, used to
+	// decode gRPC responses.
+	GRPCDescriptors string
+	Descriptors     *protoregistry.Files
+	// "binary" or "compact".
+	Thrift      string
+	Normalizers NormalizerList
+
+	// Buckets requests. gRPC and Thrift calls are bucketed by method unless
+	// this is set.
+	Bucketer      Bucketer
+	RequireBucket string
+	ExcludeBucket string
+
+	PrintStats     bool
+	GraphiteHost   string
+	GraphitePrefix string
+
+	// Derived from UnorderedArrays and ArrayKeys.
+	unorderedArrays []unorderedSpec
+
+	// Derived from Buckets: the options for each bucket with a policy.
+	buckets map[string]*Options
+}
+
+// DefaultOptions returns the options diffmirror runs with if no flags are
+// given, with the exception of PrintStats, which is off.
+func DefaultOptions() *Options {
+	return &Options{
+		Workers:           10,
+		MaxIdleConns:      10,
+		NameA:             "a",
+		NameA2:            "a2",
+		NameB:             "b",
+		ProtoA:            "http1",
+		ProtoA2:           "http1",
+		ProtoB:            "http1",
+		DiffLogMaxBody:    64 * 1024,
+		ComparatorTimeout: 5 * time.Second,
+		MaxDiffRate:       -1,
+		MaxErrorRate:      -1,
+		MaxP99Regression:  -1,
+		IgnoreErrors:      true,
+		CompareBodyOnly:   true,
+		IgnoreHeaders:     []string{"Date"},
+		CompareMode:       "bytes",
+		SampleRate:        1,
+	}
+}
+
+func (s *Options) HasThresholds() bool {
+	return s.MaxDiffRate.IsSet() || s.MaxErrorRate.IsSet() || s.MaxP99Regression.IsSet()
+}
+
+// checkGRPCProtos checks that every host is sent gRPC calls over HTTP/2, as
+// h2c or over TLS.
+func (s *Options) checkGRPCProtos() error {
+	hosts := []struct{ host, proto, flag string }{
+		{s.HostA, s.ProtoA, "proto-a"},
+		{s.HostA2, s.ProtoA2, "proto-noise-host"},
+		{s.HostB, s.ProtoB, "proto-b"},
+	}
+	for _, h := range hosts {
+		if h.host == "" {
+			continue
+		}
+		scheme, _, _ := splitScheme(h.host)
+		if h.proto != "h2" && scheme != "https" {
+			return fmt.Errorf("grpc requires HTTP/2: set --%s h2, or connect to %s with https://", h.flag, h.host)
+		}
+	}
+	return nil
+}
+
+// prepare checks that the options are consistent, and derives those that
+// depend on others.
+func (s *Options) prepare() error {
+	if s.Workers <= 0 {
+		return fmt.Errorf("workers must be positive")
+	}
+
+	if s.HostA == "" || s.HostB == "" {
+		return fmt.Errorf("hostA and hostB are required")
+	}
+
+	for _, host := range []string{s.HostA, s.HostA2, s.HostB} {
+		if _, _, err := splitScheme(host); err != nil {
+			return err
+		}
+	}
+
+	for _, proto := range []string{s.ProtoA, s.ProtoA2, s.ProtoB} {
+		if proto != "http1" && proto != "h2" {
+			return fmt.Errorf("unknown protocol %q", proto)
+		}
+	}
+
+	s.CompareHeaders = canonicalHeaders(s.CompareHeaders)
+	s.IgnoreHeaders = canonicalHeaders(s.IgnoreHeaders)
+
+	switch s.CompareMode {
+	case "bytes", "json", "status":
+	default:
+		return fmt.Errorf("unknown comparison mode %q", s.CompareMode)
+	}
+
+	if s.GRPCDescriptors != "" {
+		files, err := loadDescriptors(s.GRPCDescriptors)
+		if err != nil {
+			return err
+		}
+		s.Descriptors = files
+	}
+
+	if s.Descriptors != nil {
+		if !s.GRPC {
+			return fmt.Errorf("grpc-descriptors requires --grpc")
+		}
+		if s.CompareMode != "bytes" {
+			return fmt.Errorf("grpc-descriptors cannot be combined with --compare")
+		}
+	}
+
+	if s.GRPC {
+		if err := s.checkGRPCProtos(); err != nil {
+			return err
+		}
+		// gRPC status codes are only compared by the grpc comparator (or,
+		// alone, by the status comparator), since they are sent in trailers.
+		switch s.CompareMode {
+		case "bytes":
+			s.CompareMode = "grpc"
+		case "status":
+		default:
+			return fmt.Errorf("grpc cannot be combined with --compare %s", s.CompareMode)
+		}
+		if s.Bucketer == nil {
+			s.Bucketer = &GRPCMethodBucketer{}
+		}
+	}
+
+	switch s.Thrift {
+	case "":
+	case "binary", "compact":
+		if s.CompareMode != "bytes" {
+			return fmt.Errorf("thrift cannot be combined with --compare or --grpc")
+		}
+		s.CompareMode = "thrift"
+		if s.Bucketer == nil {
+			s.Bucketer = &ThriftMethodBucketer{Compact: s.Thrift == "compact"}
+		}
+	default:
+		return fmt.Errorf("unknown thrift protocol %q", s.Thrift)
+	}
+
+	if s.ComparatorServer != "" {
+		if s.ComparatorTimeout <= 0 {
+			return fmt.Errorf("comparator-timeout must be positive")
+		}
+		if s.CompareCmd != "" {
+			return fmt.Errorf("cannot specify both compare-cmd and comparator-server")
+		}
+		if s.structured() {
+			return fmt.Errorf("comparator-server compares payloads as bytes, and cannot be combined with structured comparison")
+		}
+	}
+
+	if len(s.IgnorePaths) > 0 && !s.structured() {
+		return fmt.Errorf("ignore-path requires comparing structurally, eg with --compare json")
+	}
+
+	if s.HostA2 != "" && !s.structured() {
+		return fmt.Errorf("noise-host requires comparing structurally, eg with --compare json")
+	}
+
+	specs, err := unorderedSpecs(s.UnorderedArrays, s.ArrayKeys)
+	if err != nil {
+		return err
+	}
+	s.unorderedArrays = specs
+
+	if len(s.unorderedArrays) > 0 && !s.structured() {
+		return fmt.Errorf("unordered-array and array-key require comparing structurally, eg with --compare json")
+	}
+
+	if s.FloatTolerance < 0 {
+		return fmt.Errorf("float-tolerance must not be negative")
+	}
+
+	if (s.FloatTolerance > 0 || s.RelativeTolerance > 0) && !s.structured() {
+		return fmt.Errorf("float-tolerance and relative-tolerance require comparing structurally, eg with --compare json")
+	}
+
+	if s.ExcludeBucket != "" && s.RequireBucket != "" {
+		return fmt.Errorf("cannot specify both require-bucket and exclude-bucket")
+	}
+
+	if (s.ExcludeBucket != "" || s.RequireBucket != "") && s.Bucketer == nil {
+		return fmt.Errorf("filtering by buckets requires a bucketer be configured")
+	}
+
+	if err := s.checkSampleRate(); err != nil {
+		return err
+	}
+
+	if len(s.Buckets) > 0 && s.Bucketer == nil {
+		return fmt.Errorf("bucket policies require a bucketer be configured")
+	}
+
+	s.buckets = make(map[string]*Options, len(s.Buckets))
+	for bucket, p := range s.Buckets {
+		o, err := p.apply(s)
+		if err != nil {
+			return fmt.Errorf("bucket %q: %s", bucket, err)
+		}
+		s.buckets[bucket] = o
+	}
+
+	return nil
+}
+
+// structured reports whether payloads are decoded and compared field by
+// field, rather than as bytes or not at all.
+func (s *Options) structured() bool {
+	return s.CompareMode != "bytes" && s.CompareMode != "status"
+}
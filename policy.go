@@ -0,0 +1,114 @@
+package diffmirror
+
+import (
+	"fmt"
+)
+
+// A BucketPolicy overrides, for requests in one bucket, how they are sampled
+// and compared. Unset fields keep the value from Options.
+type BucketPolicy struct {
+	// "bytes", "json" or "status".
+	CompareMode     string       `json:"compare"`
+	IgnorePaths     SelectorList `json:"ignore-path"`
+	UnorderedArrays SelectorList `json:"unordered-array"`
+	ArrayKeys       SelectorList `json:"array-key"`
+
+	FloatTolerance    *float64 `json:"float-tolerance"`
+	RelativeTolerance *Ratio   `json:"relative-tolerance"`
+
+	SampleRate   *Ratio `json:"sample-rate"`
+	IgnoreErrors *bool  `json:"ignore-errors"`
+}
+
+// apply returns a copy of s with the policy's overrides applied.
+func (p *BucketPolicy) apply(s *Options) (*Options, error) {
+	o := new(Options)
+	*o = *s
+	o.buckets = nil
+
+	if p.CompareMode != "" {
+		switch p.CompareMode {
+		case "bytes", "json", "status":
+		default:
+			return nil, fmt.Errorf("unknown comparison mode %q", p.CompareMode)
+		}
+		// gRPC and Thrift responses can only be compared as such, or by
+		// status alone, so as not to lose the status comparison.
+		if (s.CompareMode == "grpc" || s.CompareMode == "thrift") && p.CompareMode != "status" {
+			return nil, fmt.Errorf("%s responses cannot be compared with compare %s, only status", s.CompareMode, p.CompareMode)
+		}
+		o.CompareMode = p.CompareMode
+	}
+
+	if p.IgnorePaths != nil {
+		o.IgnorePaths = p.IgnorePaths
+	}
+
+	if p.UnorderedArrays != nil || p.ArrayKeys != nil {
+		specs, err := unorderedSpecs(p.UnorderedArrays, p.ArrayKeys)
+		if err != nil {
+			return nil, err
+		}
+		o.unorderedArrays = specs
+	}
+
+	if p.FloatTolerance != nil {
+		if *p.FloatTolerance < 0 {
+			return nil, fmt.Errorf("float-tolerance must not be negative")
+		}
+		o.FloatTolerance = *p.FloatTolerance
+	}
+
+	if p.RelativeTolerance != nil {
+		o.RelativeTolerance = *p.RelativeTolerance
+	}
+
+	if p.SampleRate != nil {
+		o.SampleRate = *p.SampleRate
+	}
+
+	if p.IgnoreErrors != nil {
+		o.IgnoreErrors = *p.IgnoreErrors
+	}
+
+	// Only settings given here, rather than inherited, need to make sense
+	// with the mode.
+	if !o.structured() && (p.IgnorePaths != nil || p.UnorderedArrays != nil || p.ArrayKeys != nil || p.FloatTolerance != nil || p.RelativeTolerance != nil) {
+		return nil, fmt.Errorf("ignore-path, unordered-array, array-key and tolerances require comparing structurally, eg with compare json")
+	}
+
+	return o, o.checkSampleRate()
+}
+
+func (s *Options) checkSampleRate() error {
+	if s.SampleRate < 0 || s.SampleRate > 1 {
+		return fmt.Errorf("sample-rate must be between 0 and 100%%")
+	}
+	return nil
+}
+
+// forBucket returns the options for requests in a bucket.
+func (s *Options) forBucket(bucket string) *Options {
+	if o, found := s.buckets[bucket]; found {
+		return o
+	}
+	return s
+}
+
+// A policy compares responses as a set of options configure: the
+// diffReporter's own, or those for a bucket with a BucketPolicy.
+type policy struct {
+	*diffReporter
+
+	settings *Options
+	differ   *differ
+}
+
+func newPolicy(d *diffReporter, s *Options) *policy {
+	p := &policy{diffReporter: d, settings: s}
+	p.differ = &differ{absTolerance: s.FloatTolerance, relTolerance: float64(s.RelativeTolerance)}
+	if s.FloatTolerance > 0 || s.RelativeTolerance > 0 {
+		p.differ.onDelta = d.recordDelta
+	}
+	return p
+}
@@ -0,0 +1,160 @@
+package diffmirror
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Where a stat is reported to Prometheus: a metric family, and labels
+// distinguishing it from others in the family.
+type statLabels struct {
+	family string
+	labels []string
+}
+
+// Label reports a stat to Prometheus as family{key="value", ...}, given
+// alternating keys and values, rather than under a name derived from the
+// stat's, eg so that the bucket and host in `diffing.search.err.a` are labels
+// of diffing_err.
+func (t *Stats) Label(stat, family string, labels ...string) {
+	if _, found := t.labels.Load(stat); found {
+		return
+	}
+	t.labels.Store(stat, &statLabels{family: family, labels: labels})
+}
+
+// Quantiles of timings reported to Prometheus.
+var promQuantiles = []float64{0.5, 0.75, 0.9, 0.95, 0.99, 0.999}
+
+// A series of samples sharing a metric family.
+type promFamily struct {
+	typ     string
+	samples []string
+}
+
+// WritePrometheus writes every stat to w in the Prometheus text format.
+// Counts are reported as counters, gauges as gauges and timings, in seconds,
+// as summaries.
+func (t *Stats) WritePrometheus(w io.Writer) error {
+	families := make(map[string]*promFamily)
+	add := func(family, typ, suffix string, labels []string, value float64) {
+		f, found := families[family]
+		if !found {
+			f = &promFamily{typ: typ}
+			families[family] = f
+		}
+		f.samples = append(f.samples, family+suffix+promLabels(labels)+" "+promValue(value))
+	}
+
+	t.registry.Each(func(name string, i interface{}) {
+		switch m := i.(type) {
+		case metrics.Counter:
+			// Every count also has a meter, which Prometheus has no need of.
+			stat := strings.TrimSuffix(name, "-total")
+			family, labels := t.labelsFor(stat)
+			add(family+"_total", "counter", "", labels, float64(m.Count()))
+
+		case metrics.Gauge:
+			family, labels := t.labelsFor(name)
+			add(family, "gauge", "", labels, float64(m.Value()))
+
+		case metrics.GaugeFloat64:
+			family, labels := t.labelsFor(name)
+			add(family, "gauge", "", labels, m.Value())
+
+		case metrics.Timer:
+			family, labels := t.labelsFor(name)
+			family += "_seconds"
+			snap := m.Snapshot()
+			for i, v := range snap.Percentiles(promQuantiles) {
+				quantile := strconv.FormatFloat(promQuantiles[i], 'g', -1, 64)
+				add(family, "summary", "", append(labels[:len(labels):len(labels)], "quantile", quantile), v/1e9)
+			}
+			var sum int64
+			if s, found := t.timingSums.Load(name); found {
+				sum = atomic.LoadInt64(s.(*int64))
+			}
+			add(family, "summary", "_sum", labels, float64(sum)/1e9)
+			add(family, "summary", "_count", labels, float64(snap.Count()))
+		}
+	})
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := bufio.NewWriter(w)
+	for _, name := range names {
+		f := families[name]
+		sort.Strings(f.samples)
+		fmt.Fprintf(out, "# TYPE %s %s\n", name, f.typ)
+		for _, sample := range f.samples {
+			fmt.Fprintln(out, sample)
+		}
+	}
+	return out.Flush()
+}
+
+// labelsFor returns the family and labels a stat is reported under: those it
+// was given by Label, or a family named for it without any labels.
+func (t *Stats) labelsFor(stat string) (string, []string) {
+	if l, found := t.labels.Load(stat); found {
+		l := l.(*statLabels)
+		return l.family, l.labels
+	}
+	return promName(stat), nil
+}
+
+// promName replaces the characters Prometheus does not allow in metric names,
+// eg `mirror.ignored-bucket` becomes `mirror_ignored_bucket`.
+func promName(stat string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, stat)
+}
+
+func promLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(promEscaper.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
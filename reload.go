@@ -0,0 +1,127 @@
+package diffmirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+)
+
+// A snapshot is the configuration a request is mirrored and compared with.
+// Reloading swaps it as a whole, so each request sees either the old or the
+// new options, never a mix.
+type snapshot struct {
+	// The options as given, and as prepared for use.
+	given    *Options
+	settings *Options
+
+	// Chains of comparators for each bucket, with the default under "".
+	comparators map[string][]Comparator
+
+	// The stat counting the substitutions made by each of the normalizers.
+	normalizerStats []string
+}
+
+// snapshot builds the comparators configured by s, prepared from given.
+func (d *diffReporter) snapshot(given, s *Options) *snapshot {
+	snap := &snapshot{given: given, settings: s, normalizerStats: d.statsForNormalizers(s.Normalizers)}
+	snap.comparators = make(map[string][]Comparator, len(s.buckets)+len(s.Comparators)+1)
+	for bucket, o := range s.buckets {
+		snap.comparators[bucket] = newPolicy(d, o).comparators()
+	}
+	for bucket, chain := range s.Comparators {
+		snap.comparators[bucket] = chain
+	}
+	if _, found := snap.comparators[""]; !found {
+		snap.comparators[""] = newPolicy(d, s).comparators()
+	}
+	return snap
+}
+
+// Options which configure the connections, workers and outputs New sets up,
+// so cannot be reloaded.
+var fixedOptions = []string{
+	"Workers", "MaxIdleConns", "MaxOpenConns",
+	"UpstreamCA", "UpstreamCert", "UpstreamKey", "UpstreamServerName", "InsecureSkipVerify",
+	"HostA", "NameA", "HostA2", "NameA2", "HostB", "NameB", "ProtoA", "ProtoA2", "ProtoB",
+	"ProxyPrimary", "GRPC", "RequestsFile", "DiffLog", "DiffLogMaxBody", "Sinks", "ComparatorServer", "ComparatorTimeout",
+	"MaxDiffRate", "MaxErrorRate", "MaxP99Regression",
+	"PrintStats", "GraphiteHost", "GraphitePrefix",
+}
+
+// Reload swaps the options requests are bucketed, filtered, sampled and
+// compared with for those in o, logging what changed. Requests already being
+// mirrored finish with the options they started with, and queues, stats and
+// connections are kept. Changes to fixedOptions are ignored, with a warning.
+func (m *Mirror) Reload(o *Options) error {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	return m.reload(o)
+}
+
+// reload is Reload, with reloadLock held.
+func (m *Mirror) reload(o *Options) error {
+	old := m.current.Load().settings
+
+	given := new(Options)
+	*given = *o
+
+	newValue, oldValue := reflect.ValueOf(given).Elem(), reflect.ValueOf(old).Elem()
+	for _, name := range fixedOptions {
+		f := newValue.FieldByName(name)
+		if describeOption(f) != describeOption(oldValue.FieldByName(name)) {
+			log.Printf("Ignoring change to %s when reloading: it requires a restart.", name)
+			f.Set(oldValue.FieldByName(name))
+		}
+	}
+
+	s := new(Options)
+	*s = *given
+	if err := s.prepare(); err != nil {
+		return err
+	}
+	m.current.Store(m.reporter.snapshot(given, s))
+
+	changes := optionChanges(old, s)
+	if len(changes) == 0 {
+		log.Printf("Reloaded options: nothing changed.")
+		return nil
+	}
+	log.Printf("Reloaded options:\n\t%s", strings.Join(changes, "\n\t"))
+	return nil
+}
+
+// optionChanges describes each exported option which differs between old and
+// s, eg `CompareMode: "bytes" -> "json"`.
+func optionChanges(old, s *Options) []string {
+	oldValue, newValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(s).Elem()
+
+	var changes []string
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		before, after := describeOption(oldValue.Field(i)), describeOption(newValue.Field(i))
+		if before != after {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", field.Name, before, after))
+		}
+	}
+	return changes
+}
+
+// describeOption renders an option the way it would be given: as a flag if
+// it is one, otherwise as json.
+func describeOption(v reflect.Value) string {
+	if s, ok := v.Addr().Interface().(fmt.Stringer); ok {
+		return s.String()
+	}
+	if v.Kind() == reflect.Interface {
+		return fmt.Sprintf("%+v", v.Interface())
+	}
+	if b, err := json.Marshal(v.Interface()); err == nil {
+		return string(b)
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
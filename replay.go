@@ -0,0 +1,42 @@
+package diffmirror
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/dt/gor_request_files/requestfiles"
+)
+
+// Large enough for any request gor would have recorded.
+const maxReplayRequestSize = 5 * 1024 * 1024
+
+// Replay feeds each request recorded in a gor request file to the workers,
+// then waits for all of them to be mirrored and compared.
+func (m *Mirror) Replay(path string) error {
+	in := requestfiles.NewFileInput(path)
+	buf := make([]byte, maxReplayRequestSize)
+
+	count := 0
+	for {
+		n, err := in.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading requests from %s: %s", path, err)
+		}
+
+		raw := make([]byte, n)
+		copy(raw, buf[:n])
+
+		// Unlike live traffic, replayed requests wait for room in the queue,
+		// and while paused, rather than being dropped.
+		m.submitReplayed(raw)
+		count++
+	}
+
+	log.Printf("Read %d requests from %s, waiting for them to finish...", count, path)
+	m.Wait()
+	return nil
+}
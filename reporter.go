@@ -1,40 +1,56 @@
-package main
+package diffmirror
 
 import (
 	"bytes"
 	"encoding/hex"
-	"io"
+	"fmt"
 	"log"
 	"net/http"
-	"os/exec"
-	"sort"
+	"regexp"
+	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/dt/gor_request_files/requestfiles"
 )
 
-type DiffReporter struct {
+type diffReporter struct {
 	total int64
+	match int64
 	diff  int64
+	noise int64
+	errA  int64
+	errB  int64
 
-	settings *Settings
+	settings *Options
 
 	bucket *Bucketer
 
-	stats             *Stats
-	statNames         StatNames
-	detailedStatNames map[string]*StatNames
+	stats     *Stats
+	statNames statNames
+
+	// Guards detailedStatNames, which has an entry for each bucket seen.
+	bucketsLock       sync.Mutex
+	detailedStatNames map[string]*statNames
+
+	sinks  []Sink
+	recent *recentDiffs
+
+	comparator *comparatorServer
+
+	// The largest difference seen between numbers at each path.
+	deltaLock sync.Mutex
+	maxDelta  map[string]float64
 
-	// If writing out diffs, need a queue to serialize to a single writer.
-	outQueue       chan []byte
-	requestsWriter io.Writer
+	// The stat counting substitutions made by each normalizer, by its text,
+	// numbered in the order they were first configured.
+	normalizersLock sync.Mutex
+	normalizerStats map[string]string
 }
 
 // Compute these once at startup to avoid allocating them every time
-type StatNames struct {
+type statNames struct {
 	diff  string
 	match string
+	noise string
 	total string
 
 	errA string
@@ -44,63 +60,196 @@ type StatNames struct {
 	rttB string
 }
 
-func NewDiffReporter(s *Settings, stats *Stats) (d *DiffReporter) {
-	r := new(DiffReporter)
+func newDiffReporter(s *Options, stats *Stats) (*diffReporter, error) {
+	r := new(diffReporter)
 
 	r.settings = s
 
 	r.stats = stats
 
-	r.statNames = StatNames{
+	r.statNames = statNames{
 		total: "diffing.total",
 		match: "diffing.match",
 		diff:  "diffing.diff",
-		errA:  "diffing.err." + s.nameA,
-		errB:  "diffing.err." + s.nameB,
-		rttA:  "diffing.rtt." + s.nameA,
-		rttB:  "diffing.rtt." + s.nameB,
+		noise: "diffing.noise",
+		errA:  "diffing.err." + s.NameA,
+		errB:  "diffing.err." + s.NameB,
+		rttA:  "diffing.rtt." + s.NameA,
+		rttB:  "diffing.rtt." + s.NameB,
 	}
+	r.statNames.label(stats, "diffing", s)
 
-	r.detailedStatNames = make(map[string]*StatNames)
+	r.detailedStatNames = make(map[string]*statNames)
+
+	r.maxDelta = make(map[string]float64)
+
+	r.normalizerStats = make(map[string]string)
+
+	// On failure, close the sinks opened so far, but not those given.
+	fail := func(err error) (*diffReporter, error) {
+		r.Close()
+		return nil, err
+	}
 
-	if s.requestsFile != "" {
-		r.outQueue = make(chan []byte, 100)
-		r.requestsWriter = requestfiles.NewFileOutput(s.requestsFile)
-		go r.writeDiffs()
+	if s.RequestsFile != "" {
+		r.sinks = append(r.sinks, newRequestsFile(s.RequestsFile))
 	}
 
-	return r
+	if s.DiffLog != "" {
+		l, err := newDiffLog(s.DiffLog, s.DiffLogMaxBody)
+		if err != nil {
+			return fail(err)
+		}
+		r.sinks = append(r.sinks, l)
+	}
+
+	if s.ComparatorServer != "" {
+		c, err := startComparatorServer(s.ComparatorServer, s.ComparatorTimeout)
+		if err != nil {
+			return fail(err)
+		}
+		r.comparator = c
+	}
+
+	r.sinks = append(r.sinks, s.Sinks...)
+
+	r.recent = new(recentDiffs)
+	r.sinks = append(r.sinks, r.recent)
+
+	return r, nil
 }
 
-func (d *DiffReporter) statNamesFor(bucket string) *StatNames {
+func (d *diffReporter) statNamesFor(bucket string) *statNames {
+	d.bucketsLock.Lock()
+	defer d.bucketsLock.Unlock()
+
 	if s, found := d.detailedStatNames[bucket]; found {
 		return s
 	}
 
-	s := &StatNames{
+	s := &statNames{
 		total: "diffing." + bucket + ".total",
 		match: "diffing." + bucket + ".match",
 		diff:  "diffing." + bucket + ".diff",
-		errA:  "diffing." + bucket + ".err." + d.settings.nameA,
-		errB:  "diffing." + bucket + ".err." + d.settings.nameB,
-		rttA:  "diffing." + bucket + ".rtt." + d.settings.nameA,
-		rttB:  "diffing." + bucket + ".rtt." + d.settings.nameB,
+		noise: "diffing." + bucket + ".noise",
+		errA:  "diffing." + bucket + ".err." + d.settings.NameA,
+		errB:  "diffing." + bucket + ".err." + d.settings.NameB,
+		rttA:  "diffing." + bucket + ".rtt." + d.settings.NameA,
+		rttB:  "diffing." + bucket + ".rtt." + d.settings.NameB,
 	}
+	s.label(d.stats, "diffing_bucket", d.settings, "bucket", bucket)
 	d.detailedStatNames[bucket] = s
 	return s
 }
 
-func (d *DiffReporter) writeDiffs() {
-	for {
-		req := <-d.outQueue
-		d.requestsWriter.Write(req)
+// label reports the stats to Prometheus in families with the given prefix,
+// labelled with the host each is for, if any, and the given labels.
+func (n *statNames) label(stats *Stats, prefix string, s *Options, labels ...string) {
+	host := func(name string) []string {
+		return append(labels[:len(labels):len(labels)], "host", name)
 	}
+	stats.Label(n.total, prefix+"_requests", labels...)
+	stats.Label(n.match, prefix+"_matches", labels...)
+	stats.Label(n.diff, prefix+"_diffs", labels...)
+	stats.Label(n.noise, prefix+"_noise", labels...)
+	stats.Label(n.errA, prefix+"_errors", host(s.NameA)...)
+	stats.Label(n.errB, prefix+"_errors", host(s.NameB)...)
+	stats.Label(n.rttA, prefix+"_rtt", host(s.NameA)...)
+	stats.Label(n.rttB, prefix+"_rtt", host(s.NameB)...)
+}
+
+// Counts of the requests compared in a bucket.
+type bucketCounts struct {
+	Total    int64   `json:"total"`
+	Match    int64   `json:"match"`
+	Diff     int64   `json:"diff"`
+	Noise    int64   `json:"noise"`
+	DiffRate float64 `json:"diff_rate"`
 }
 
-func (d *DiffReporter) Compare(req *http.Request, raw []byte, resA, resB *MirrorResp, bucket string) {
+// bucketCounts returns the counts for each bucket seen so far.
+func (d *diffReporter) bucketCounts() map[string]*bucketCounts {
+	d.bucketsLock.Lock()
+	defer d.bucketsLock.Unlock()
+
+	counts := make(map[string]*bucketCounts, len(d.detailedStatNames))
+	for bucket, names := range d.detailedStatNames {
+		c := &bucketCounts{
+			Total: d.stats.GetCount(names.total),
+			Match: d.stats.GetCount(names.match),
+			Diff:  d.stats.GetCount(names.diff),
+			Noise: d.stats.GetCount(names.noise),
+		}
+		if c.Total > 0 {
+			c.DiffRate = float64(c.Diff) / float64(c.Total)
+		}
+		counts[bucket] = c
+	}
+	return counts
+}
+
+var arrayIndex = regexp.MustCompile(`\[[0-9]+\]`)
+
+// recordDelta tracks the largest difference between numbers seen at each
+// path, with array indexes replaced by [*], as diffing.delta.<path>.
+func (d *diffReporter) recordDelta(path string, delta float64) {
+	path = arrayIndex.ReplaceAllString(path, "[*]")
+
+	d.deltaLock.Lock()
+	defer d.deltaLock.Unlock()
+
+	if delta > d.maxDelta[path] {
+		d.maxDelta[path] = delta
+		d.stats.Label("diffing.delta."+path, "diffing_max_delta", "path", path)
+		d.stats.GaugeFloat("diffing.delta."+path, delta)
+	}
+}
+
+// Close flushes any pending writes to the sinks, and stops any comparator
+// server, returning the first error closing a sink. Compare must not be called
+// after Close.
+func (d *diffReporter) Close() error {
+	var first error
+	for _, sink := range d.sinks {
+		if err := sink.Close(); err != nil && first == nil {
+			first = fmt.Errorf("error closing sink: %s", err)
+		}
+	}
+	if d.comparator != nil {
+		d.comparator.Close()
+	}
+	return first
+}
+
+func (d *diffReporter) PrintSummary() {
+	total := atomic.LoadInt64(&d.total)
+	diff := atomic.LoadInt64(&d.diff)
+
+	rate := 0.0
+	if total > 0 {
+		rate = 100 * float64(diff) / float64(total)
+	}
+
+	log.Printf("Compared %d requests: %d matched, %d differed (%.2f%%), %d differed only by noise, errors: %d from %s, %d from %s",
+		total,
+		atomic.LoadInt64(&d.match),
+		diff,
+		rate,
+		atomic.LoadInt64(&d.noise),
+		atomic.LoadInt64(&d.errA), d.settings.NameA,
+		atomic.LoadInt64(&d.errB), d.settings.NameB,
+	)
+}
+
+// Compare records the results of sending req to each host. resA2, from a
+// second copy of A, may be nil; if present it is used to tell which
+// differences between A and B are noise.
+func (d *diffReporter) Compare(snap *snapshot, req *http.Request, raw []byte, resA, resA2, resB *MirrorResp, bucket string) {
+	s := snap.settings
+
 	atomic.AddInt64(&d.total, 1)
 
-	var bucketStats *StatNames
+	var bucketStats *statNames
 	if bucket != "" {
 		bucketStats = d.statNamesFor(bucket)
 	}
@@ -114,6 +263,7 @@ func (d *DiffReporter) Compare(req *http.Request, raw []byte, resA, resB *Mirror
 	errB := resB.isErr()
 
 	if errA {
+		atomic.AddInt64(&d.errA, 1)
 		d.stats.Inc(d.statNames.errA)
 		if bucketStats != nil {
 			d.stats.Inc(bucketStats.errA)
@@ -126,6 +276,7 @@ func (d *DiffReporter) Compare(req *http.Request, raw []byte, resA, resB *Mirror
 	}
 
 	if errB {
+		atomic.AddInt64(&d.errB, 1)
 		d.stats.Inc(d.statNames.errB)
 		if bucketStats != nil {
 			d.stats.Inc(bucketStats.errB)
@@ -137,41 +288,41 @@ func (d *DiffReporter) Compare(req *http.Request, raw []byte, resA, resB *Mirror
 		}
 	}
 
-	if d.settings.skipDiff {
+	if s.SkipDiff {
 		return
 	}
 
-	if (errA && errB) || (d.settings.ignoreErrors && (errA || errB)) {
+	if (errA && errB) || (s.forBucket(bucket).IgnoreErrors && (errA || errB)) {
 		return
 	}
 
-	same := (!errA && !errB) && len(resA.payload) == len(resB.payload)
-
-	if same {
-		if d.settings.ignoreBodyOrder {
-			normA := make([]byte, len(resA.payload))
-			copy(normA, resA.payload)
-
-			normB := make([]byte, len(resB.payload))
-			copy(normB, resB.payload)
-			sort.Sort(sortBytes(normA))
-			sort.Sort(sortBytes(normB))
-			same = bytes.Equal(normA, normB)
-		} else {
-			same = resA.payload == resB.payload
-			if !same && d.settings.compareCmd != "" {
-				cmd := exec.Command(d.settings.compareCmd, hex.EncodeToString([]byte(resA.payload)), hex.EncodeToString([]byte(resB.payload)))
-				output, ret := cmd.CombinedOutput()
-				if ret != nil {
-					log.Printf("Compare via %s: %v:\n%s\n", d.settings.compareCmd, ret, output)
-				} else {
-					same = true
-				}
-			}
+	// Bodies are compared decoded, so a difference in encoding is only
+	// counted, and reported as a difference in the header if it is compared.
+	encodingDiffers := !errA && !errB && resA.encoding != resB.encoding
+	if encodingDiffers {
+		d.stats.Inc("diffing.encoding-differs")
+		if bucketStats != nil {
+			d.stats.Label("diffing."+bucket+".encoding-differs", "diffing_bucket_encoding_differs", "bucket", bucket)
+			d.stats.Inc("diffing." + bucket + ".encoding-differs")
+		}
+	}
+
+	if len(s.Normalizers) > 0 {
+		resA, resB = d.normalize(snap, resA), d.normalize(snap, resB)
+		if resA2 != nil {
+			resA2 = d.normalize(snap, resA2)
 		}
 	}
 
-	if same {
+	c := d.compare(snap, req, bucket, resA, resB)
+	if encodingDiffers && !contains(c.Headers, "Content-Encoding") {
+		if bs := s.forBucket(bucket); bs.comparesHeaders() && bs.comparesHeader("Content-Encoding") {
+			c.Headers = append(c.Headers, "Content-Encoding")
+		}
+	}
+
+	if c.Same() {
+		atomic.AddInt64(&d.match, 1)
 		d.stats.Inc(d.statNames.match)
 		if bucketStats != nil {
 			d.stats.Inc(bucketStats.match)
@@ -179,11 +330,57 @@ func (d *DiffReporter) Compare(req *http.Request, raw []byte, resA, resB *Mirror
 		return
 	}
 
+	// Differences that also appear between two copies of A are noise, but an
+	// error from B is never noise.
+	if resA2 != nil && !errA && !errB && !resA2.isErr() {
+		if noise := d.compare(snap, req, bucket, resA, resA2); !noise.Same() {
+			c = c.without(noise)
+			if c.Same() {
+				atomic.AddInt64(&d.noise, 1)
+				d.stats.Inc(d.statNames.noise)
+				if bucketStats != nil {
+					d.stats.Inc(bucketStats.noise)
+				}
+				return
+			}
+		}
+	}
+
 	atomic.AddInt64(&d.diff, 1)
 	d.stats.Inc(d.statNames.diff)
 	if bucketStats != nil {
 		d.stats.Inc(bucketStats.diff)
 	}
+
+	// Counters are kept per path in any element of an array, so that there
+	// are only as many as there are fields in responses, and count the diffs
+	// with a difference at each.
+	counted := make(map[string]bool, len(c.Paths))
+	for _, p := range c.Paths {
+		p = arrayIndex.ReplaceAllString(p, "[*]")
+		if counted[p] {
+			continue
+		}
+		counted[p] = true
+		d.stats.Label("diffing.path."+p, "diffing_path_diffs", "path", p)
+		d.stats.Inc("diffing.path." + p)
+		if bucketStats != nil {
+			d.stats.Label("diffing."+bucket+".path."+p, "diffing_bucket_path_diffs", "bucket", bucket, "path", p)
+			d.stats.Inc("diffing." + bucket + ".path." + p)
+		}
+	}
+
+	for _, h := range c.Headers {
+		d.stats.Label("diffing.header."+h, "diffing_header_diffs", "header", h)
+		d.stats.Inc("diffing.header." + h)
+		if bucketStats != nil {
+			d.stats.Label("diffing."+bucket+".header."+h, "diffing_bucket_header_diffs", "bucket", bucket, "header", h)
+			d.stats.Inc("diffing." + bucket + ".header." + h)
+		}
+	}
+	// Show what the comparator server compared, if it normalized the payloads.
+	resA, resB = c.shown(resA, c.NormalizedA), c.shown(resB, c.NormalizedB)
+
 	sizeA := len(resA.payload)
 	sizeB := len(resB.payload)
 
@@ -229,6 +426,7 @@ func (d *DiffReporter) Compare(req *http.Request, raw []byte, resA, resB *Mirror
 
 	log.Printf(
 		`[DIFF %s%d/%d] %s %s [status: %d v %d size: %d v %d (%d) time: %dms vs %dms (%d)]
+		%s
 		bytes %d - %d
 		######## req ########
 		%s
@@ -250,21 +448,247 @@ func (d *DiffReporter) Compare(req *http.Request, raw []byte, resA, resB *Mirror
 		resA.status, resB.status,
 		sizeA, sizeB, sizeA-sizeB,
 		ms(resA.rtt), ms(resB.rtt), ms(resA.rtt-resB.rtt),
+		c.describe(),
 		start,
 		end,
 		body,
-		d.settings.nameA,
+		d.settings.NameA,
 		string(snipA),
 		hexA,
-		d.settings.nameB,
+		d.settings.NameB,
 		string(snipB),
 		hexB,
 	)
 
-	if d.requestsWriter != nil {
-		d.outQueue <- raw
+	diff := &Diff{
+		Request:    req,
+		Raw:        raw,
+		Bucket:     bucket,
+		NameA:      d.settings.NameA,
+		NameB:      d.settings.NameB,
+		A:          resA,
+		B:          resB,
+		Comparison: c,
+		FirstDiff:  i,
+	}
+	for _, sink := range d.sinks {
+		sink.Diff(diff)
+	}
+}
+
+// statsForNormalizers returns the stat counting substitutions made by each
+// of ns. A normalizer keeps its stat across reloads, and any not seen before
+// are numbered after those that were.
+func (d *diffReporter) statsForNormalizers(ns NormalizerList) []string {
+	d.normalizersLock.Lock()
+	defer d.normalizersLock.Unlock()
+
+	names := make([]string, len(ns))
+	for i, n := range ns {
+		name, found := d.normalizerStats[n.text]
+		if !found {
+			name = fmt.Sprintf("diffing.normalized.%d", len(d.normalizerStats)+1)
+			d.normalizerStats[n.text] = name
+			d.stats.Label(name, "diffing_normalized", "normalizer", n.text)
+			log.Printf("Substitutions made by normalizer %s are counted in %s", n.text, name)
+		}
+		names[i] = name
+	}
+	return names
+}
+
+// normalize returns a copy of res with the normalizers applied to its payload
+// and body.
+func (d *diffReporter) normalize(snap *snapshot, res *MirrorResp) *MirrorResp {
+	s := snap.settings
+	n := *res
+	for i, norm := range s.Normalizers {
+		var count int
+		n.payload, count = norm.apply(n.payload)
+		if count > 0 {
+			d.stats.Add(snap.normalizerStats[i], count)
+		}
+	}
+
+	if s.CompareBodyOnly {
+		n.body = []byte(n.payload)
+	} else {
+		body := string(n.body)
+		for _, norm := range s.Normalizers {
+			body, _ = norm.apply(body)
+		}
+		n.body = []byte(body)
+	}
+	return &n
+}
+
+// compare runs the chain of comparators for a bucket, or the default chain.
+func (d *diffReporter) compare(snap *snapshot, req *http.Request, bucket string, resA, resB *MirrorResp) *Comparison {
+	if resA.isErr() || resB.isErr() {
+		return &Comparison{Payload: true}
 	}
 
+	chain, found := snap.comparators[bucket]
+	if !found {
+		chain = snap.comparators[""]
+	}
+
+	c := new(Comparison)
+	for _, cmp := range chain {
+		c = cmp.Compare(req, resA, resB, c)
+	}
+	return c
+}
+
+// comparators builds the chain of comparators the policy's options configure.
+func (p *policy) comparators() []Comparator {
+	var chain []Comparator
+	switch p.settings.CompareMode {
+	case "json":
+		chain = append(chain, ComparatorFunc(p.compareJSON))
+	case "grpc":
+		chain = append(chain, ComparatorFunc(p.compareGRPC))
+	case "thrift":
+		chain = append(chain, ComparatorFunc(p.compareThrift))
+	case "status":
+		chain = append(chain, StatusComparator{})
+	default:
+		if p.settings.IgnoreBodyOrder {
+			chain = append(chain, SortedBytesComparator{})
+			break
+		}
+		chain = append(chain, BytesComparator{})
+		if p.settings.CompareCmd != "" {
+			chain = append(chain, &CommandComparator{Cmd: p.settings.CompareCmd})
+		}
+		if p.comparator != nil {
+			chain = append(chain, ComparatorFunc(p.compareWithServer))
+		}
+	}
+
+	if p.settings.comparesHeaders() {
+		chain = append(chain, ComparatorFunc(p.compareHeaders))
+	}
+	return chain
+}
+
+// compareHeaders records which of the compared headers differ.
+func (p *policy) compareHeaders(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison {
+	c.Headers = append(c.Headers, headerDiff(p.settings.comparedHeaders(resA.header), p.settings.comparedHeaders(resB.header))...)
+	return c
+}
+
+// compareWithServer asks the comparator server whether differing payloads,
+// of any length, are equal. If it cannot answer, the payloads still differ.
+func (p *policy) compareWithServer(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison {
+	if !c.Payload {
+		return c
+	}
+
+	res, err := p.comparator.compare(req, resA.payload, resB.payload)
+	if err != nil {
+		log.Printf("Compare via %s: %s", p.settings.ComparatorServer, err)
+		p.stats.Inc("diffing.comparator-error")
+		return c
+	}
+
+	c.Payload = !res.Equal
+	c.Explanation = res.Explanation
+	c.NormalizedA, c.NormalizedB = res.A, res.B
+	return c
+}
+
+// compareJSON compares bodies structurally, falling back to comparing bytes
+// if either is not valid json. Unless comparing bodies only, the status must
+// also match.
+func (p *policy) compareJSON(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison {
+	if !p.settings.CompareBodyOnly && resA.status != resB.status {
+		c.Paths = append(c.Paths, "status")
+	}
+
+	a, errA := decodeJSON(resA.body)
+	b, errB := decodeJSON(resB.body)
+	if errA != nil || errB != nil {
+		p.stats.Inc("diffing.invalid-json")
+		if !bytes.Equal(resA.body, resB.body) {
+			c.Paths = append(c.Paths, "$")
+		}
+	} else {
+		c.Paths = p.structDiff(a, b, c.Paths)
+	}
+
+	return c
+}
+
+// compareGRPC compares the status codes and, if the method's response type
+// is known, the decoded messages of gRPC responses. Otherwise, messages are
+// compared byte-for-byte.
+func (p *policy) compareGRPC(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison {
+	if resA.status != resB.status {
+		c.Paths = append(c.Paths, "status")
+	}
+
+	if p.settings.Descriptors == nil {
+		c.Payload = !bytes.Equal(resA.body, resB.body)
+		return c
+	}
+
+	desc, err := findOutput(p.settings.Descriptors, req.URL.Path)
+	if err != nil {
+		p.stats.Inc("diffing.unknown-method")
+		c.Payload = !bytes.Equal(resA.body, resB.body)
+		return c
+	}
+
+	a, errA := decodeGRPC(desc, resA)
+	b, errB := decodeGRPC(desc, resB)
+	if errA != nil || errB != nil {
+		p.stats.Inc("diffing.invalid-proto")
+		c.Payload = !bytes.Equal(resA.body, resB.body)
+		return c
+	}
+
+	c.Paths = p.structDiff(a, b, c.Paths)
+	return c
+}
+
+// compareThrift compares the message types and decoded structs of thrift
+// responses, reporting differing fields by id, eg $.0.2 for field 2 of the
+// result. Unless comparing bodies only, the status must also match.
+func (p *policy) compareThrift(req *http.Request, resA, resB *MirrorResp, c *Comparison) *Comparison {
+	if !p.settings.CompareBodyOnly && resA.status != resB.status {
+		c.Paths = append(c.Paths, "status")
+	}
+
+	compact := p.settings.Thrift == "compact"
+	a, errA := readThriftMessage(resA.body, compact, false)
+	b, errB := readThriftMessage(resB.body, compact, false)
+	if errA != nil || errB != nil {
+		p.stats.Inc("diffing.invalid-thrift")
+		c.Payload = !bytes.Equal(resA.body, resB.body)
+		return c
+	}
+
+	if a.typ != b.typ {
+		c.Paths = append(c.Paths, "type")
+	}
+
+	c.Paths = p.structDiff(a.body, b.body, c.Paths)
+	return c
+}
+
+// structDiff appends the paths at which two decoded payloads differ, after
+// removing any ignored paths and marking any unordered arrays.
+func (p *policy) structDiff(a, b interface{}, paths []string) []string {
+	for _, sel := range p.settings.IgnorePaths {
+		a = sel.remove(a)
+		b = sel.remove(b)
+	}
+	for _, u := range p.settings.unorderedArrays {
+		a = u.mark(a)
+		b = u.mark(b)
+	}
+	return p.differ.diff("$", a, b, paths)
 }
 
 func ms(d time.Duration) time.Duration {
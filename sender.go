@@ -1,60 +1,272 @@
-package main
+package diffmirror
 
 import (
-	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func asyncSend(back chan *MirrorResp, r *http.Request, addr string, bodyOnly bool) {
-	back <- sendAndTime(r, addr, bodyOnly)
-}
+// An upstream is a host requests are mirrored to, along with the pool of
+// keep-alive connections used to reach it.
+type upstream struct {
+	name   string
+	scheme string
+	addr   string
 
-func sendAndTime(r *http.Request, addr string, bodyOnly bool) *MirrorResp {
-	start := time.Now()
-	res := send(r, addr, bodyOnly)
-	res.rtt = time.Now().Sub(start)
-	return &res
+	stats     *Stats
+	transport *http.Transport
+
+	conns  int64
+	reused int64
+
+	statDial   string
+	statNew    string
+	statReused string
+	statReuse  string
+
+	statInvalidEncoding string
 }
 
-func send(r *http.Request, addr string, bodyOnly bool) MirrorResp {
-	c, err := net.Dial("tcp", addr)
+func newUpstream(name, host, proto string, s *Options, stats *Stats) (*upstream, error) {
+	scheme, addr, err := splitScheme(host)
 	if err != nil {
-		return MirrorResp{err: fmt.Errorf("error establishing tcp connection to %s: %s", addr, err)}
+		return nil, err
+	}
+
+	u := &upstream{
+		name:   name,
+		scheme: scheme,
+		addr:   addr,
+		stats:  stats,
+
+		statDial:   "upstream." + name + ".dial",
+		statNew:    "upstream." + name + ".conn.new",
+		statReused: "upstream." + name + ".conn.reused",
+		statReuse:  "upstream." + name + ".conn.reuse-pct",
+
+		statInvalidEncoding: "upstream." + name + ".invalid-encoding",
+	}
+	stats.Label(u.statDial, "upstream_dial", "host", name)
+	stats.Label(u.statNew, "upstream_conns_new", "host", name)
+	stats.Label(u.statReused, "upstream_conns_reused", "host", name)
+	stats.Label(u.statReuse, "upstream_conns_reuse_pct", "host", name)
+	stats.Label(u.statInvalidEncoding, "upstream_invalid_encoding", "host", name)
+
+	u.transport = &http.Transport{
+		DialContext:         (&net.Dialer{KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConnsPerHost: s.MaxIdleConns,
+		MaxConnsPerHost:     s.MaxOpenConns,
+		IdleConnTimeout:     90 * time.Second,
+		// Responses are compared exactly as the host sent them.
+		DisableCompression: true,
+	}
+
+	if scheme == "https" {
+		cfg, err := upstreamTLSConfig(s)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring tls for %s: %s", host, err)
+		}
+		u.transport.TLSClientConfig = cfg
+	}
+
+	// gRPC over TLS negotiates HTTP/2 whatever the protocol given.
+	if proto == "h2" || (s.GRPC && scheme == "https") {
+		// Over plaintext this is h2c with prior knowledge.
+		p := new(http.Protocols)
+		if scheme == "https" {
+			p.SetHTTP2(true)
+		} else {
+			p.SetUnencryptedHTTP2(true)
+		}
+		u.transport.Protocols = p
 	}
-	defer c.Close()
+	return u, nil
+}
+
+// close closes the upstream's idle connections, which once every request has
+// been compared is all of them.
+func (u *upstream) close() {
+	u.transport.CloseIdleConnections()
+}
 
-	if err = r.Write(c); err != nil {
-		return MirrorResp{err: fmt.Errorf("error initializing write to %s: %s", addr, err)}
+func (u *upstream) asyncSend(back chan *MirrorResp, r *http.Request, s *Options) {
+	back <- u.send(r, s)
+}
+
+// connUse records how a request used its connection.
+type connUse struct {
+	dial   time.Duration
+	reused bool
+
+	// When a connection was ready to send on, ie excluding any time spent
+	// waiting for or dialing one.
+	ready time.Time
+}
+
+func (u *upstream) roundTrip(r *http.Request) (*http.Response, connUse, error) {
+	// A dial abandoned in favour of a connection freed up meanwhile may
+	// still report in after the request is done, so access is locked.
+	var lock sync.Mutex
+	var dialStart time.Time
+	use := connUse{ready: time.Now()}
+
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(_, _ string) {
+			lock.Lock()
+			dialStart = time.Now()
+			lock.Unlock()
+		},
+		ConnectDone: func(_, _ string, _ error) {
+			lock.Lock()
+			use.dial += time.Now().Sub(dialStart)
+			lock.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			lock.Lock()
+			use.reused = info.Reused
+			use.ready = time.Now()
+			lock.Unlock()
+		},
 	}
 
-	read := bufio.NewReader(c)
-	resp, err := http.ReadResponse(read, nil)
+	out := r.Clone(httptrace.WithClientTrace(r.Context(), trace))
+	out.RequestURI = ""
+	out.URL.Scheme = u.scheme
+	out.URL.Host = u.addr
+
+	resp, err := u.transport.RoundTrip(out)
+
+	lock.Lock()
+	defer lock.Unlock()
 
 	if err != nil {
-		return MirrorResp{err: fmt.Errorf("error reading response from %s: %s", addr, err)}
+		return nil, use, fmt.Errorf("error sending request to %s: %s", u.addr, err)
 	}
 
+	u.recordConn(use)
+	return resp, use, nil
+}
+
+func (u *upstream) recordConn(use connUse) {
+	conns := atomic.AddInt64(&u.conns, 1)
+	reused := atomic.LoadInt64(&u.reused)
+	if use.reused {
+		reused = atomic.AddInt64(&u.reused, 1)
+		u.stats.Inc(u.statReused)
+	} else {
+		u.stats.Inc(u.statNew)
+		u.stats.Timing(u.statDial, use.dial)
+	}
+	u.stats.Gauge(u.statReuse, int(100*reused/conns))
+}
+
+func (u *upstream) send(r *http.Request, s *Options) *MirrorResp {
+	resp, use, err := u.roundTrip(r)
+	if err != nil {
+		return &MirrorResp{err: err}
+	}
 	defer resp.Body.Close()
 
-	if bodyOnly {
-		contents, err := ioutil.ReadAll(resp.Body)
+	res := u.capture(resp, s)
+	res.rtt = time.Now().Sub(use.ready)
+	res.dial = use.dial
+	return &res
+}
+
+// proxy sends r and copies the response to out as it is read, returning the
+// captured response for comparison.
+func (u *upstream) proxy(out http.ResponseWriter, r *http.Request, s *Options) *MirrorResp {
+	start := time.Now()
+
+	resp, use, err := u.roundTrip(r)
+	if err != nil {
+		http.Error(out, err.Error(), http.StatusBadGateway)
+		return &MirrorResp{err: err, rtt: time.Now().Sub(start)}
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		if !contains(hopHeaders, k) {
+			out.Header()[k] = v
+		}
+	}
+	out.WriteHeader(resp.StatusCode)
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(io.MultiWriter(out, &buf), resp.Body); err != nil {
+		return &MirrorResp{err: fmt.Errorf("error proxying response from %s: %s", u.addr, err), rtt: time.Now().Sub(use.ready)}
+	}
+	resp.Body = ioutil.NopCloser(&buf)
+
+	for k, v := range resp.Trailer {
+		out.Header()[http.TrailerPrefix+k] = v
+	}
+
+	res := u.capture(resp, s)
+	res.rtt = time.Now().Sub(use.ready)
+	res.dial = use.dial
+	return &res
+}
+
+// capture reads a response for comparison, as s configures, decoding its
+// body according to its Content-Encoding.
+func (u *upstream) capture(resp *http.Response, s *Options) MirrorResp {
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return MirrorResp{err: fmt.Errorf("error reading response body from %s: %s", u.addr, err)}
+	}
+
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding != "" {
+		decoded, err := decodeBody(encoding, contents, maxDecodedBodySize)
 		if err != nil {
-			panic(err)
+			// Compare what was sent instead.
+			log.Printf("error decoding response from %s: %s", u.addr, err)
+			u.stats.Inc(u.statInvalidEncoding)
+		} else {
+			contents = decoded
+		}
+	}
+
+	res := MirrorResp{status: resp.StatusCode, header: resp.Header, encoding: encoding, body: contents}
+
+	if s.GRPC && resp.StatusCode == http.StatusOK {
+		res.grpc = true
+		res.status = grpcStatus(resp)
+		res.header = resp.Header.Clone()
+		for k, v := range resp.Trailer {
+			res.header[k] = v
 		}
-		return MirrorResp{status: resp.StatusCode, payload: string(contents)}
+	}
+
+	if s.CompareBodyOnly {
+		res.payload = string(contents)
 	} else {
-		delete(resp.Header, "Date")
+		// Dump every response as HTTP/1.1 with a known length, so the
+		// comparison does not depend on how each host framed or encoded it.
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+		resp.TransferEncoding = nil
+		resp.ContentLength = int64(len(contents))
+		resp.Trailer = nil
+
+		resp.Header = s.comparedHeaders(resp.Header)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(contents))
 		respString, err := httputil.DumpResponse(resp, true)
 
 		if err != nil {
-			return MirrorResp{err: fmt.Errorf("error dumping response from %s: %s", addr, err)}
+			return MirrorResp{err: fmt.Errorf("error dumping response from %s: %s", u.addr, err)}
 		}
 
-		return MirrorResp{status: resp.StatusCode, payload: string(respString)}
+		res.payload = string(respString)
 	}
+	return res
 }
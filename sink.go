@@ -0,0 +1,141 @@
+package diffmirror
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/dt/gor_request_files/requestfiles"
+)
+
+// A Diff describes a request to which the hosts' responses differed.
+type Diff struct {
+	Request *http.Request
+	// The request as it was received, including its body.
+	Raw    []byte
+	Bucket string
+
+	NameA, NameB string
+	A, B         *MirrorResp
+
+	Comparison *Comparison
+	// Offset into the compared payloads of the first differing byte.
+	FirstDiff int
+}
+
+// A Sink is sent every Diff. It is called by the workers comparing
+// responses, so should not block for long.
+type Sink interface {
+	Diff(d *Diff)
+	// Close flushes anything pending. No Diffs are sent after Close.
+	Close() error
+}
+
+// A Flusher is a Sink which can be asked to write out anything it has queued
+// or buffered, eg before its output is copied elsewhere.
+type Flusher interface {
+	Flush() error
+}
+
+// requestsFile is a Sink recording requests which produced diffs, in a gor
+// compatible file. Writes are queued to a single writer.
+type requestsFile struct {
+	queue chan requestsFileOp
+	w     io.Writer
+	done  chan struct{}
+}
+
+// Either a request to write, or a flush to report the result of once every
+// request queued before it is written.
+type requestsFileOp struct {
+	req     []byte
+	flushed chan error
+}
+
+func newRequestsFile(path string) *requestsFile {
+	f := &requestsFile{
+		queue: make(chan requestsFileOp, 100),
+		w:     requestfiles.NewFileOutput(path),
+		done:  make(chan struct{}),
+	}
+	go f.write()
+	return f
+}
+
+func (f *requestsFile) write() {
+	for op := range f.queue {
+		if op.flushed == nil {
+			f.w.Write(op.req)
+			continue
+		}
+		var err error
+		if fl, ok := f.w.(Flusher); ok {
+			err = fl.Flush()
+		}
+		op.flushed <- err
+	}
+	if c, ok := f.w.(io.Closer); ok {
+		c.Close()
+	}
+	close(f.done)
+}
+
+func (f *requestsFile) Diff(d *Diff) {
+	f.queue <- requestsFileOp{req: d.Raw}
+}
+
+func (f *requestsFile) Flush() error {
+	flushed := make(chan error, 1)
+	f.queue <- requestsFileOp{flushed: flushed}
+	return <-flushed
+}
+
+func (f *requestsFile) Close() error {
+	close(f.queue)
+	<-f.done
+	return nil
+}
+
+// Length of the recentDiffs kept, and bodies in them.
+const (
+	recentDiffsLen     = 100
+	recentDiffsMaxBody = 4 * 1024
+)
+
+// recentDiffs is a Sink keeping the last few diffs, as the diff log would
+// describe them, for the admin api.
+type recentDiffs struct {
+	lock    sync.Mutex
+	entries []*diffLogEntry
+	next    int
+}
+
+func (r *recentDiffs) Diff(d *Diff) {
+	e := newDiffLogEntry(d, recentDiffsMaxBody)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.entries) < recentDiffsLen {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % recentDiffsLen
+}
+
+// get returns the diffs kept, most recent first.
+func (r *recentDiffs) get() []*diffLogEntry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	entries := make([]*diffLogEntry, 0, len(r.entries))
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		entries = append(entries, r.entries[(r.next+i)%len(r.entries)])
+	}
+	return entries
+}
+
+func (r *recentDiffs) Close() error {
+	return nil
+}
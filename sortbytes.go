@@ -1,4 +1,4 @@
-package main
+package diffmirror
 
 type sortBytes []byte
 
@@ -1,10 +1,12 @@
-package main
+package diffmirror
 
 import (
+	"io"
 	"log"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dt/go-metrics-graphite"
@@ -14,33 +16,93 @@ import (
 type Stats struct {
 	registry metrics.Registry
 	lock     sync.Mutex
+
+	// For Prometheus: the *statLabels of stats given them by Label, and the
+	// total, in nanoseconds, of every timing (of which the registry only
+	// keeps a sample).
+	labels     sync.Map
+	timingSums sync.Map
+
+	// Closed to stop the goroutines started by report.
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 func (t *Stats) Gauge(name string, value int) {
 	metrics.GetOrRegisterGauge(name, t.registry).Update(int64(value))
 }
 
+func (t *Stats) GaugeFloat(name string, value float64) {
+	metrics.GetOrRegisterGaugeFloat64(name, t.registry).Update(value)
+}
+
+func (t *Stats) GetGaugeFloat(name string) float64 {
+	if g, ok := t.registry.Get(name).(metrics.GaugeFloat64); ok {
+		return g.Value()
+	}
+	return 0
+}
+
 func (t *Stats) Inc(stat string) {
 	metrics.GetOrRegisterCounter(stat+"-total", t.registry).Inc(1)
 	metrics.GetOrRegisterMeter(stat, t.registry).Mark(1)
 }
 
+func (t *Stats) Add(stat string, n int) {
+	metrics.GetOrRegisterCounter(stat+"-total", t.registry).Inc(int64(n))
+	metrics.GetOrRegisterMeter(stat, t.registry).Mark(int64(n))
+}
+
 func (t *Stats) GetCount(stat string) int64 {
 	c := t.registry.Get(stat)
 	if c == nil {
 		return 0
 	}
-	return c.(metrics.Counter).Count()
+	switch c := c.(type) {
+	case metrics.Counter:
+		return c.Count()
+	case metrics.Meter:
+		return c.Count()
+	}
+	return 0
 }
 
 func (t *Stats) Timing(stat string, d time.Duration) {
 	metrics.GetOrRegisterTimer(stat, t.registry).Update(d)
+
+	sum, found := t.timingSums.Load(stat)
+	if !found {
+		sum, _ = t.timingSums.LoadOrStore(stat, new(int64))
+	}
+	atomic.AddInt64(sum.(*int64), int64(d))
+}
+
+func (t *Stats) Percentile(stat string, p float64) time.Duration {
+	c := t.registry.Get(stat)
+	if c == nil {
+		return 0
+	}
+	return time.Duration(c.(metrics.Timer).Percentile(p))
+}
+
+// WriteJSON writes the current value of every stat to w.
+func (t *Stats) WriteJSON(w io.Writer) {
+	metrics.WriteJSONOnce(t.registry, w)
 }
 
 func NewStats(sendToConsole bool, sendToGraphite, graphitePrefix string) *Stats {
-	s := new(Stats)
-	s.registry = metrics.NewRegistry()
+	s := newStats()
+	s.report(sendToConsole, sendToGraphite, graphitePrefix)
+	return s
+}
 
+func newStats() *Stats {
+	return &Stats{registry: metrics.NewRegistry(), done: make(chan struct{})}
+}
+
+// report starts periodically sending stats to the console and graphite, as
+// configured, until stopReporting is called.
+func (s *Stats) report(sendToConsole bool, sendToGraphite, graphitePrefix string) {
 	if sendToGraphite != "" {
 		log.Println("Stats reporting to graphite: ", sendToGraphite)
 		addr, _ := net.ResolveTCPAddr("tcp", sendToGraphite)
@@ -54,12 +116,42 @@ func NewStats(sendToConsole bool, sendToGraphite, graphitePrefix string) *Stats
 			Percentiles:   []float64{0.5, 0.75, 0.9, 0.95, 0.99, 0.999},
 		}
 
-		go graphite.GraphiteWithConfig(cfg)
+		s.every(cfg.FlushInterval, func() {
+			if err := graphite.GraphiteOnce(cfg); err != nil {
+				log.Println("Error sending stats to graphite:", err)
+			}
+		})
 	}
 
 	if sendToConsole {
 		log.Println("Stats reporting enabled...")
-		go metrics.Log(s.registry, time.Minute, log.New(os.Stderr, "metrics: ", log.Lmicroseconds))
+		logger := log.New(os.Stderr, "metrics: ", log.Lmicroseconds)
+		s.every(time.Minute, func() {
+			cue := make(chan interface{}, 1)
+			cue <- struct{}{}
+			close(cue)
+			metrics.LogOnCue(s.registry, cue, logger)
+		})
 	}
-	return s
+}
+
+// every calls f every interval until stopReporting is called.
+func (s *Stats) every(interval time.Duration, f func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// stopReporting stops sending stats to the console and graphite.
+func (s *Stats) stopReporting() {
+	s.stopOnce.Do(func() { close(s.done) })
 }
@@ -0,0 +1,26 @@
+#!/usr/bin/env python
+
+# An example --comparator-server, which considers payloads equal if they only
+# differ in case.
+
+import base64
+import json
+import sys
+
+while True:
+  line = sys.stdin.readline()
+  if not line:
+    break
+  req = json.loads(line)
+
+  a = base64.b64decode(req['a']).lower()
+  b = base64.b64decode(req['b']).lower()
+
+  res = {'id': req['id'], 'equal': a == b}
+  if a != b:
+    res['explanation'] = 'differ by more than case'
+    res['a'] = base64.b64encode(a).decode('ascii')
+    res['b'] = base64.b64encode(b).decode('ascii')
+
+  sys.stdout.write(json.dumps(res) + '\n')
+  sys.stdout.flush()
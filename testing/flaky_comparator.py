@@ -0,0 +1,32 @@
+#!/usr/bin/env python
+
+# A --comparator-server for tests, which considers payloads equal if they only
+# differ in case, but misbehaves when asked to compare payloads containing
+# 'crash' (by exiting), 'hang' (by never responding) or 'garbage' (by
+# responding with something other than json).
+
+import base64
+import json
+import sys
+import time
+
+while True:
+  line = sys.stdin.readline()
+  if not line:
+    break
+  req = json.loads(line)
+
+  a = base64.b64decode(req['a']).lower()
+  b = base64.b64decode(req['b']).lower()
+
+  if b'crash' in a:
+    sys.exit(1)
+  if b'hang' in a:
+    time.sleep(3600)
+  if b'garbage' in a:
+    sys.stdout.write('garbage\n')
+    sys.stdout.flush()
+    continue
+
+  sys.stdout.write(json.dumps({'id': req['id'], 'equal': a == b}) + '\n')
+  sys.stdout.flush()
@@ -0,0 +1,491 @@
+package diffmirror
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Thrift message types.
+const (
+	thriftCall      = 1
+	thriftReply     = 2
+	thriftException = 3
+	thriftOneway    = 4
+)
+
+// Deeper nesting of structs and collections than this is assumed to be garbage
+// rather than a real message.
+const maxThriftDepth = 64
+
+// A thriftMessage is a decoded message envelope and its struct, with fields
+// keyed by their ids.
+type thriftMessage struct {
+	name  string
+	typ   int
+	seqID int32
+	body  map[string]interface{}
+}
+
+type thriftReader struct {
+	buf     []byte
+	compact bool
+}
+
+// readThriftMessage decodes a message in the binary or compact protocol,
+// with or without a frame size prefix. If headerOnly is set, the body is not
+// decoded.
+func readThriftMessage(payload []byte, compact, headerOnly bool) (*thriftMessage, error) {
+	if len(payload) >= 4 && int(binary.BigEndian.Uint32(payload)) == len(payload)-4 {
+		payload = payload[4:]
+	}
+
+	r := &thriftReader{buf: payload, compact: compact}
+
+	var msg *thriftMessage
+	var err error
+	if compact {
+		msg, err = r.readCompactHeader()
+	} else {
+		msg, err = r.readBinaryHeader()
+	}
+	if err != nil || headerOnly {
+		return msg, err
+	}
+
+	msg.body, err = r.readStruct(0)
+	return msg, err
+}
+
+func (r *thriftReader) take(n int) ([]byte, error) {
+	if n < 0 || n > len(r.buf) {
+		return nil, fmt.Errorf("truncated thrift payload")
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b, nil
+}
+
+func (r *thriftReader) readByte() (byte, error) {
+	b, err := r.take(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (r *thriftReader) readI16() (int16, error) {
+	if r.compact {
+		v, err := r.readZigzag()
+		return int16(v), err
+	}
+	b, err := r.take(2)
+	if err != nil {
+		return 0, err
+	}
+	return int16(binary.BigEndian.Uint16(b)), nil
+}
+
+func (r *thriftReader) readI32() (int32, error) {
+	if r.compact {
+		v, err := r.readZigzag()
+		return int32(v), err
+	}
+	b, err := r.take(4)
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(b)), nil
+}
+
+func (r *thriftReader) readI64() (int64, error) {
+	if r.compact {
+		return r.readZigzag()
+	}
+	b, err := r.take(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b)), nil
+}
+
+func (r *thriftReader) readDouble() (float64, error) {
+	b, err := r.take(8)
+	if err != nil {
+		return 0, err
+	}
+	if r.compact {
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+}
+
+func (r *thriftReader) readVarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid varint in thrift payload")
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+func (r *thriftReader) readZigzag() (int64, error) {
+	v, err := r.readVarint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+func (r *thriftReader) readSize() (int, error) {
+	var size int64
+	if r.compact {
+		v, err := r.readVarint()
+		if err != nil {
+			return 0, err
+		}
+		size = int64(v)
+	} else {
+		v, err := r.readI32()
+		if err != nil {
+			return 0, err
+		}
+		size = int64(v)
+	}
+	// Every element takes at least a byte, so this also bounds allocations.
+	if size < 0 || size > int64(len(r.buf)) {
+		return 0, fmt.Errorf("invalid size %d in thrift payload", size)
+	}
+	return int(size), nil
+}
+
+func (r *thriftReader) readString() (string, error) {
+	size, err := r.readSize()
+	if err != nil {
+		return "", err
+	}
+	b, err := r.take(size)
+	return string(b), err
+}
+
+func (r *thriftReader) readBinaryHeader() (*thriftMessage, error) {
+	msg := new(thriftMessage)
+
+	first, err := r.readI32()
+	if err != nil {
+		return nil, err
+	}
+
+	if first < 0 {
+		if uint32(first)&0xffff0000 != 0x80010000 {
+			return nil, fmt.Errorf("unsupported thrift binary protocol version %x", uint32(first))
+		}
+		msg.typ = int(first & 0xff)
+		if msg.name, err = r.readString(); err != nil {
+			return nil, err
+		}
+	} else {
+		// Old, non-strict messages start with the name.
+		name, err := r.take(int(first))
+		if err != nil {
+			return nil, err
+		}
+		msg.name = string(name)
+		typ, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		msg.typ = int(typ)
+	}
+
+	msg.seqID, err = r.readI32()
+	return msg, err
+}
+
+func (r *thriftReader) readCompactHeader() (*thriftMessage, error) {
+	id, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	if id != 0x82 {
+		return nil, fmt.Errorf("unexpected thrift compact protocol id %x", id)
+	}
+
+	versionAndType, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	if versionAndType&0x1f != 1 {
+		return nil, fmt.Errorf("unsupported thrift compact protocol version %d", versionAndType&0x1f)
+	}
+
+	msg := &thriftMessage{typ: int(versionAndType >> 5)}
+	seqID, err := r.readVarint()
+	if err != nil {
+		return nil, err
+	}
+	msg.seqID = int32(seqID)
+	msg.name, err = r.readString()
+	return msg, err
+}
+
+// Field types, normalized to those of the binary protocol.
+const (
+	thriftStop   = 0
+	thriftBool   = 2
+	thriftByte   = 3
+	thriftDouble = 4
+	thriftI16    = 6
+	thriftI32    = 8
+	thriftI64    = 10
+	thriftString = 11
+	thriftStruct = 12
+	thriftMap    = 13
+	thriftSet    = 14
+	thriftList   = 15
+	thriftUUID   = 16
+)
+
+var compactTypes = map[byte]byte{
+	0:  thriftStop,
+	1:  thriftBool,
+	2:  thriftBool,
+	3:  thriftByte,
+	4:  thriftI16,
+	5:  thriftI32,
+	6:  thriftI64,
+	7:  thriftDouble,
+	8:  thriftString,
+	9:  thriftList,
+	10: thriftSet,
+	11: thriftMap,
+	12: thriftStruct,
+	13: thriftUUID,
+}
+
+func (r *thriftReader) readType(t byte) (byte, error) {
+	if !r.compact {
+		return t, nil
+	}
+	typ, ok := compactTypes[t]
+	if !ok {
+		return 0, fmt.Errorf("unknown thrift compact type %d", t)
+	}
+	return typ, nil
+}
+
+func (r *thriftReader) readStruct(depth int) (map[string]interface{}, error) {
+	if depth > maxThriftDepth {
+		return nil, fmt.Errorf("thrift struct nested too deeply")
+	}
+
+	fields := make(map[string]interface{})
+	var lastID int16
+	for {
+		header, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		var id int16
+		var typ byte
+		if r.compact {
+			if header&0x0f == 0 {
+				return fields, nil
+			}
+			if typ, err = r.readType(header & 0x0f); err != nil {
+				return nil, err
+			}
+			if delta := int16(header >> 4); delta != 0 {
+				id = lastID + delta
+			} else if id, err = r.readI16(); err != nil {
+				return nil, err
+			}
+			lastID = id
+		} else {
+			if header == thriftStop {
+				return fields, nil
+			}
+			typ = header
+			if id, err = r.readI16(); err != nil {
+				return nil, err
+			}
+		}
+
+		var v interface{}
+		if r.compact && typ == thriftBool {
+			// Compact booleans are stored in the field header.
+			v = header&0x0f == 1
+		} else if v, err = r.readValue(typ, depth); err != nil {
+			return nil, err
+		}
+		fields[strconv.Itoa(int(id))] = v
+	}
+}
+
+func (r *thriftReader) readElemType() (byte, error) {
+	t, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	return r.readType(t)
+}
+
+func (r *thriftReader) readCollectionHeader() (byte, int, error) {
+	if !r.compact {
+		elem, err := r.readElemType()
+		if err != nil {
+			return 0, 0, err
+		}
+		size, err := r.readSize()
+		return elem, size, err
+	}
+
+	header, err := r.readByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	elem, err := r.readType(header & 0x0f)
+	if err != nil {
+		return 0, 0, err
+	}
+	size := int(header >> 4)
+	if size == 15 {
+		if size, err = r.readSize(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return elem, size, nil
+}
+
+func (r *thriftReader) readValue(typ byte, depth int) (interface{}, error) {
+	if depth > maxThriftDepth {
+		return nil, fmt.Errorf("thrift value nested too deeply")
+	}
+
+	switch typ {
+	case thriftBool:
+		b, err := r.readByte()
+		return b == 1, err
+
+	case thriftByte:
+		b, err := r.readByte()
+		return json.Number(strconv.Itoa(int(int8(b)))), err
+
+	case thriftI16:
+		v, err := r.readI16()
+		return json.Number(strconv.Itoa(int(v))), err
+
+	case thriftI32:
+		v, err := r.readI32()
+		return json.Number(strconv.Itoa(int(v))), err
+
+	case thriftI64:
+		v, err := r.readI64()
+		return json.Number(strconv.FormatInt(v, 10)), err
+
+	case thriftDouble:
+		v, err := r.readDouble()
+		return json.Number(strconv.FormatFloat(v, 'g', -1, 64)), err
+
+	case thriftString:
+		return r.readString()
+
+	case thriftUUID:
+		b, err := r.take(16)
+		return hex.EncodeToString(b), err
+
+	case thriftStruct:
+		return r.readStruct(depth + 1)
+
+	case thriftList, thriftSet:
+		elem, size, err := r.readCollectionHeader()
+		if err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			if list[i], err = r.readValue(elem, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+
+	case thriftMap:
+		var keyType, valueType byte
+		var size int
+		var err error
+		if r.compact {
+			if size, err = r.readSize(); err != nil {
+				return nil, err
+			}
+			if size > 0 {
+				types, err := r.readByte()
+				if err != nil {
+					return nil, err
+				}
+				if keyType, err = r.readType(types >> 4); err != nil {
+					return nil, err
+				}
+				if valueType, err = r.readType(types & 0x0f); err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			if keyType, err = r.readElemType(); err != nil {
+				return nil, err
+			}
+			if valueType, err = r.readElemType(); err != nil {
+				return nil, err
+			}
+			if size, err = r.readSize(); err != nil {
+				return nil, err
+			}
+		}
+
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			k, err := r.readValue(keyType, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.readValue(valueType, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			m[thriftKey(k)] = v
+		}
+		return m, nil
+
+	default:
+		return nil, fmt.Errorf("unknown thrift type %d", typ)
+	}
+}
+
+// thriftKey renders a map key, which may be any thrift value, as a string.
+func thriftKey(k interface{}) string {
+	switch k := k.(type) {
+	case string:
+		return k
+	case json.Number:
+		return string(k)
+	default:
+		b, _ := json.Marshal(k)
+		return string(b)
+	}
+}
+
+// ThriftMethodBucketer buckets thrift calls by their method name, reading
+// them with the compact protocol if Compact is set, or else the binary one.
+type ThriftMethodBucketer struct {
+	Compact bool
+}
+
+func (s *ThriftMethodBucketer) Bucket(r *http.Request, payload []byte) string {
+	msg, err := readThriftMessage(payload, s.Compact, true)
+	if err != nil {
+		return ""
+	}
+	return msg.name
+}
@@ -0,0 +1,62 @@
+package diffmirror
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// splitScheme separates an optional `http://` or `https://` prefix from a
+// host, defaulting to http.
+func splitScheme(host string) (string, string, error) {
+	i := strings.Index(host, "://")
+	if i == -1 {
+		return "http", host, nil
+	}
+	switch scheme := host[:i]; scheme {
+	case "http", "https":
+		return scheme, host[i+3:], nil
+	default:
+		return "", "", fmt.Errorf("unsupported scheme %q in %s", scheme, host)
+	}
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// upstreamTLSConfig builds the configuration used to connect to https hosts.
+func upstreamTLSConfig(s *Options) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         s.UpstreamServerName,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+	}
+
+	if s.UpstreamCA != "" {
+		pool, err := loadCertPool(s.UpstreamCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if s.UpstreamCert != "" || s.UpstreamKey != "" {
+		cert, err := tls.LoadX509KeyPair(s.UpstreamCert, s.UpstreamKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,161 @@
+package diffmirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// An unorderedSpec declares the arrays a selector matches to be multisets,
+// whose elements are optionally identified by one of their fields.
+type unorderedSpec struct {
+	// nil for the top-level array.
+	sel *jsonSelector
+	key string
+}
+
+// parseArrayKey splits a selector like $.results[*].id into the array it
+// selects elements of, and the field identifying them.
+func parseArrayKey(sel *jsonSelector) (unorderedSpec, error) {
+	n := len(sel.steps)
+	if n < 2 {
+		return unorderedSpec{}, fmt.Errorf("array key %q must select a field of every element, eg $.results[*].id", sel.text)
+	}
+	elems, field := sel.steps[n-2], sel.steps[n-1]
+	if !elems.wildcard || elems.recursive || field.key == "" || field.recursive {
+		return unorderedSpec{}, fmt.Errorf("array key %q must select a field of every element, eg $.results[*].id", sel.text)
+	}
+
+	spec := unorderedSpec{key: field.key}
+	if n > 2 {
+		spec.sel = &jsonSelector{text: sel.text, steps: sel.steps[:n-2]}
+	}
+	return spec, nil
+}
+
+// unorderedSpecs combines --unordered-array and --array-key selectors. Deeper
+// arrays come first, so those nested in other unordered arrays are still
+// found.
+func unorderedSpecs(arrays, keys SelectorList) ([]unorderedSpec, error) {
+	var specs []unorderedSpec
+	for _, k := range keys {
+		spec, err := parseArrayKey(k)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	for _, sel := range arrays {
+		specs = append(specs, unorderedSpec{sel: sel})
+	}
+
+	sort.SliceStable(specs, func(i, j int) bool {
+		return specs[i].depth() > specs[j].depth()
+	})
+	return specs, nil
+}
+
+func (u unorderedSpec) depth() int {
+	if u.sel == nil {
+		return 0
+	}
+	return len(u.sel.steps)
+}
+
+// mark replaces the arrays u matches in v with unorderedArrays.
+func (u unorderedSpec) mark(v interface{}) interface{} {
+	wrap := func(v interface{}) interface{} {
+		if items, ok := v.([]interface{}); ok {
+			return &unorderedArray{items: items, key: u.key}
+		}
+		return v
+	}
+	if u.sel == nil {
+		return wrap(v)
+	}
+	return u.sel.replace(v, wrap)
+}
+
+type unorderedArray struct {
+	items []interface{}
+	key   string
+}
+
+// MarshalJSON renders elements in a canonical order, so equal multisets
+// nested in other values encode the same.
+func (u *unorderedArray) MarshalJSON() ([]byte, error) {
+	parts := make([]string, len(u.items))
+	for i, item := range u.items {
+		b, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = string(b)
+	}
+	sort.Strings(parts)
+	return []byte("[" + strings.Join(parts, ",") + "]"), nil
+}
+
+// identity is what pairs up elements of unordered arrays: the value of the
+// key field if there is one, or else the whole element.
+func (u *unorderedArray) identity(item interface{}) string {
+	if u.key != "" {
+		if m, ok := item.(map[string]interface{}); ok {
+			if k, found := m[u.key]; found {
+				b, _ := json.Marshal(k)
+				return "key:" + string(b)
+			}
+		}
+	}
+	b, _ := json.Marshal(item)
+	return "item:" + string(b)
+}
+
+// diffUnordered pairs up the elements of two unordered arrays before
+// comparing them. Differing elements are reported at their index in a, or in
+// b for those only b has.
+func (d *differ) diffUnordered(path string, a, b *unorderedArray, diffs []string) []string {
+	pending := make(map[string][]int)
+	for j, item := range b.items {
+		k := b.identity(item)
+		pending[k] = append(pending[k], j)
+	}
+
+	matchedB := make([]bool, len(b.items))
+	var onlyA []int
+	for i, item := range a.items {
+		k := a.identity(item)
+		if js := pending[k]; len(js) > 0 {
+			pending[k] = js[1:]
+			matchedB[js[0]] = true
+			diffs = d.diff(indexPath(path, i), item, b.items[js[0]], diffs)
+			continue
+		}
+		onlyA = append(onlyA, i)
+	}
+
+	var onlyB []int
+	for j, matched := range matchedB {
+		if !matched {
+			onlyB = append(onlyB, j)
+		}
+	}
+
+	// Without a key, the remaining elements are paired up in order, so a
+	// changed element is reported at the fields that changed.
+	for n := 0; n < len(onlyA) || n < len(onlyB); n++ {
+		switch {
+		case n >= len(onlyA):
+			diffs = append(diffs, indexPath(path, onlyB[n]))
+		case n >= len(onlyB) || a.key != "":
+			diffs = append(diffs, indexPath(path, onlyA[n]))
+			if n < len(onlyB) {
+				diffs = append(diffs, indexPath(path, onlyB[n]))
+			}
+		default:
+			diffs = d.diff(indexPath(path, onlyA[n]), a.items[onlyA[n]], b.items[onlyB[n]], diffs)
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,131 @@
+package diffmirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A Ratio accepts either a fraction ("0.001") or a percentage ("0.1%").
+// A negative Ratio means no threshold was set.
+type Ratio float64
+
+func (r *Ratio) String() string {
+	if *r < 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(*r)*100, 'g', -1, 64) + "%"
+}
+
+func (r *Ratio) Set(s string) error {
+	scale := 1.0
+	if strings.HasSuffix(s, "%") {
+		s = strings.TrimSuffix(s, "%")
+		scale = 0.01
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	if f < 0 {
+		return fmt.Errorf("must not be negative")
+	}
+	*r = Ratio(f * scale)
+	return nil
+}
+
+// UnmarshalJSON accepts either a number or a string, as Set does.
+func (r *Ratio) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		s = string(b)
+	}
+	return r.Set(s)
+}
+
+func (r Ratio) IsSet() bool {
+	return r >= 0
+}
+
+type Verdict struct {
+	Pass     bool     `json:"pass"`
+	Failures []string `json:"failures"`
+
+	Total int64 `json:"total"`
+	Match int64 `json:"match"`
+	Diff  int64 `json:"diff"`
+
+	DiffRate  float64            `json:"diff_rate"`
+	ErrorRate map[string]float64 `json:"error_rate"`
+
+	P99Millis     map[string]float64 `json:"p99_ms"`
+	P99Regression float64            `json:"p99_regression"`
+}
+
+// Verdict checks the results of everything compared so far against the
+// thresholds in settings.
+func (d *diffReporter) Verdict() *Verdict {
+	s := d.settings
+	v := &Verdict{
+		Total:     atomic.LoadInt64(&d.total),
+		Match:     atomic.LoadInt64(&d.match),
+		Diff:      atomic.LoadInt64(&d.diff),
+		ErrorRate: make(map[string]float64),
+		P99Millis: make(map[string]float64),
+	}
+
+	errA := atomic.LoadInt64(&d.errA)
+	errB := atomic.LoadInt64(&d.errB)
+
+	if v.Total > 0 {
+		v.DiffRate = float64(v.Diff) / float64(v.Total)
+		v.ErrorRate[s.NameA] = float64(errA) / float64(v.Total)
+		v.ErrorRate[s.NameB] = float64(errB) / float64(v.Total)
+	} else {
+		v.Failures = append(v.Failures, "no requests were compared")
+	}
+
+	// The rest of the results say nothing of requests ignored while paused.
+	if paused := d.stats.GetCount("mirror.paused"); paused > 0 {
+		v.Failures = append(v.Failures, fmt.Sprintf("%d requests were ignored while paused", paused))
+	}
+
+	p99A := d.stats.Percentile(d.statNames.rttA, 0.99)
+	p99B := d.stats.Percentile(d.statNames.rttB, 0.99)
+	v.P99Millis[s.NameA] = float64(p99A) / float64(time.Millisecond)
+	v.P99Millis[s.NameB] = float64(p99B) / float64(time.Millisecond)
+	if p99A > 0 {
+		v.P99Regression = float64(p99B-p99A) / float64(p99A)
+	}
+
+	if s.MaxDiffRate.IsSet() && v.DiffRate > float64(s.MaxDiffRate) {
+		v.Failures = append(v.Failures, fmt.Sprintf("diff rate %.4f%% exceeds %s", v.DiffRate*100, s.MaxDiffRate.String()))
+	}
+
+	if s.MaxErrorRate.IsSet() {
+		for _, name := range []string{s.NameA, s.NameB} {
+			if rate := v.ErrorRate[name]; rate > float64(s.MaxErrorRate) {
+				v.Failures = append(v.Failures, fmt.Sprintf("error rate of %s %.4f%% exceeds %s", name, rate*100, s.MaxErrorRate.String()))
+			}
+		}
+	}
+
+	if s.MaxP99Regression.IsSet() && v.P99Regression > float64(s.MaxP99Regression) {
+		v.Failures = append(v.Failures, fmt.Sprintf("p99 of %s is %.2f%% slower than %s, exceeding %s", s.NameB, v.P99Regression*100, s.NameA, s.MaxP99Regression.String()))
+	}
+
+	v.Pass = len(v.Failures) == 0
+	return v
+}
+
+func (v *Verdict) WriteFile(path string) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(out, '\n'), 0644)
+}